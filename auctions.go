@@ -0,0 +1,700 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+const (
+	minAuctionDuration = time.Hour
+	maxAuctionDuration = 14 * 24 * time.Hour
+	// A bid this close to the end pushes the end back, so there is always
+	// time left to answer a last-second bid
+	auctionSnipeWindow = 5 * time.Minute
+	auctionExtension   = 5 * time.Minute
+)
+
+// Auction sells an item to the highest bidder once EndsAt passes, provided
+// the bids reached the reserve. The reserve itself is only shown to the
+// seller; bidders see whether it has been met.
+type Auction struct {
+	ID            string    `json:"id"`
+	ItemID        string    `json:"item_id"`
+	ItemTitle     string    `json:"item_title"`
+	SellerID      string    `json:"seller_id"`
+	StartingPrice float64   `json:"starting_price"`
+	ReservePrice  *float64  `json:"reserve_price,omitempty"`
+	ReserveMet    bool      `json:"reserve_met"`
+	BidIncrement  float64   `json:"bid_increment"`
+	CurrentBid    *float64  `json:"current_bid,omitempty"`
+	MinimumBid    float64   `json:"minimum_bid"`
+	BidCount      int       `json:"bid_count"`
+	Status        string    `json:"status"`
+	EndsAt        time.Time `json:"ends_at"`
+	OrderID       string    `json:"order_id,omitempty"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+type AuctionBid struct {
+	ID         string    `json:"id"`
+	BidderName string    `json:"bidder_name"`
+	Amount     float64   `json:"amount"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// openAuctionIDSQL is the id of the open auction of item i, or an empty
+// string
+const openAuctionIDSQL = `COALESCE((SELECT a.id::text FROM auctions a WHERE a.item_id = i.id AND a.status = 'open'), '')`
+
+const auctionColumns = `a.id, a.item_id, i.title, i.seller_id, a.starting_price, a.reserve_price, a.bid_increment,
+		(SELECT MAX(b.amount) FROM auction_bids b WHERE b.auction_id = a.id),
+		(SELECT COUNT(*) FROM auction_bids b WHERE b.auction_id = a.id),
+		a.status, a.ends_at, COALESCE(a.order_id::text, ''), a.created_at`
+
+// scanAuction reads a row of auctionColumns as seen by the given user
+func scanAuction(row interface{ Scan(...interface{}) error }, auction *Auction, userID string) error {
+	err := row.Scan(&auction.ID, &auction.ItemID, &auction.ItemTitle, &auction.SellerID,
+		&auction.StartingPrice, &auction.ReservePrice, &auction.BidIncrement, &auction.CurrentBid,
+		&auction.BidCount, &auction.Status, &auction.EndsAt, &auction.OrderID, &auction.CreatedAt)
+	if err != nil {
+		return err
+	}
+
+	auction.MinimumBid = auction.StartingPrice
+	if auction.CurrentBid != nil {
+		auction.MinimumBid = *auction.CurrentBid + auction.BidIncrement
+	}
+	auction.ReserveMet = auction.CurrentBid != nil &&
+		(auction.ReservePrice == nil || *auction.CurrentBid >= *auction.ReservePrice)
+	if auction.SellerID != userID {
+		auction.ReservePrice = nil
+	}
+	return nil
+}
+
+// anyInOpenAuction reports whether one of the items, or an item grouped by
+// one of them if it is a bundle, is being auctioned. Such items can only be
+// bought by bidding.
+func anyInOpenAuction(q queryRower, itemIDs []string) (bool, error) {
+	var exists bool
+	err := q.QueryRow(`
+		SELECT EXISTS (
+			SELECT 1 FROM auctions
+			WHERE status = 'open'
+			AND (item_id = ANY($1)
+				OR item_id IN (SELECT item_id FROM bundle_items WHERE bundle_id = ANY($1))))`,
+		pq.Array(itemIDs)).Scan(&exists)
+	return exists, err
+}
+
+// hasLiveBids reports whether the item is in an open auction somebody has
+// bid on. The seller may then no longer withdraw the item, or they could
+// back out of a sale once the bids reach the reserve.
+func hasLiveBids(q queryRower, itemID string) (bool, error) {
+	var exists bool
+	err := q.QueryRow(`
+		SELECT EXISTS (
+			SELECT 1 FROM auctions a
+			JOIN auction_bids b ON b.auction_id = a.id
+			WHERE a.item_id = $1 AND a.status = 'open')`,
+		itemID).Scan(&exists)
+	return exists, err
+}
+
+// auctionsHandler lists open auctions and shows one with ?id=. Sellers
+// start an auction with POST and cancel it with DELETE while nobody has bid.
+func auctionsHandler(w http.ResponseWriter, r *http.Request) {
+	userID, _ := getUserIDFromContext(r.Context())
+
+	switch r.Method {
+	case http.MethodGet:
+		if id := r.URL.Query().Get("id"); id != "" {
+			if _, err := uuid.Parse(id); err != nil {
+				http.Error(w, "Auction not found", http.StatusNotFound)
+				return
+			}
+			var auction Auction
+			err := scanAuction(db.QueryRow(`
+				SELECT `+auctionColumns+`
+				FROM auctions a
+				JOIN items i ON a.item_id = i.id
+				WHERE a.id = $1`, id), &auction, userID)
+			if err == sql.ErrNoRows {
+				http.Error(w, "Auction not found", http.StatusNotFound)
+				return
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			sendJSON(w, auction)
+			return
+		}
+		listAuctions(w, r, userID)
+
+	case http.MethodPost:
+		createAuction(w, r, userID)
+
+	case http.MethodDelete:
+		result, err := db.Exec(`
+			UPDATE auctions a
+			SET status = 'cancelled'
+			FROM items i
+			WHERE i.id = a.item_id AND a.id = $1 AND i.seller_id = $2 AND a.status = 'open'
+			AND NOT EXISTS (SELECT 1 FROM auction_bids b WHERE b.auction_id = a.id)`,
+			r.URL.Query().Get("id"), userID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			http.Error(w, "Auction not found, already closed or already bid on", http.StatusBadRequest)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// listAuctions returns the open auctions, ending soonest first
+func listAuctions(w http.ResponseWriter, r *http.Request, userID string) {
+	keys := []sortKey{
+		{"ends_at", "a.ends_at", "timestamptz", false},
+		{"id", "a.id", "uuid", false},
+	}
+	page, err := parsePageRequest(r, "auctions", keys)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	filter := "a.status = 'open' AND i.deleted_at IS NULL"
+	var args []interface{}
+
+	total, err := page.countTotal(`
+		SELECT COUNT(*) FROM auctions a
+		JOIN items i ON a.item_id = i.id
+		WHERE ` + filter)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if cond, pageArgs := page.where(keys, len(args)+1); cond != "" {
+		filter += " AND " + cond
+		args = append(args, pageArgs...)
+	}
+
+	rows, err := db.Query(`
+		SELECT `+auctionColumns+`
+		FROM auctions a
+		JOIN items i ON a.item_id = i.id
+		WHERE `+filter+`
+		ORDER BY `+orderByKeys(keys)+page.limitClause(),
+		args...)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	auctions := make([]Auction, 0)
+	for rows.Next() {
+		var auction Auction
+		if err := scanAuction(rows, &auction, userID); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		auctions = append(auctions, auction)
+	}
+
+	result := Page{Total: total}
+	if page.hasMore(len(auctions)) {
+		auctions = auctions[:page.limit]
+		last := auctions[len(auctions)-1]
+		result.NextCursor = page.nextCursor(keys, map[string]string{
+			"ends_at": last.EndsAt.Format(time.RFC3339Nano),
+			"id":      last.ID,
+		})
+	}
+	result.Items = auctions
+
+	sendJSON(w, result)
+}
+
+func createAuction(w http.ResponseWriter, r *http.Request, userID string) {
+	var req struct {
+		ItemID        string   `json:"item_id"`
+		StartingPrice float64  `json:"starting_price"`
+		ReservePrice  *float64 `json:"reserve_price"`
+		BidIncrement  float64  `json:"bid_increment"`
+		DurationHours float64  `json:"duration_hours"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var errs []string
+	if req.StartingPrice <= 0 || req.StartingPrice >= 1e8 {
+		errs = append(errs, "starting_price must be greater than zero")
+	}
+	if req.ReservePrice != nil && (*req.ReservePrice < req.StartingPrice || *req.ReservePrice >= 1e8) {
+		errs = append(errs, "reserve_price must be at least the starting price")
+	}
+	if req.BidIncrement <= 0 || req.BidIncrement >= 1e6 {
+		errs = append(errs, "bid_increment must be greater than zero")
+	}
+	duration := time.Duration(req.DurationHours * float64(time.Hour))
+	if duration < minAuctionDuration || duration > maxAuctionDuration {
+		errs = append(errs, fmt.Sprintf("duration_hours must be between %.0f and %.0f",
+			minAuctionDuration.Hours(), maxAuctionDuration.Hours()))
+	}
+	if len(errs) > 0 {
+		http.Error(w, strings.Join(errs, "; "), http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var title string
+	var free bool
+	err = tx.QueryRow(`
+		SELECT title, is_free FROM items
+		WHERE id = $1 AND seller_id = $2 AND status = 'available' AND quantity > 0 AND deleted_at IS NULL
+		FOR UPDATE`,
+		req.ItemID, userID).Scan(&title, &free)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Item not found, not yours or not available", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if free {
+		http.Error(w, "Free items cannot be auctioned", http.StatusBadRequest)
+		return
+	}
+
+	var auctionID string
+	err = tx.QueryRow(`
+		INSERT INTO auctions (item_id, starting_price, reserve_price, bid_increment, ends_at)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id`,
+		req.ItemID, req.StartingPrice, req.ReservePrice, req.BidIncrement, time.Now().Add(duration)).Scan(&auctionID)
+	if err != nil {
+		if pgErr, ok := err.(*pq.Error); ok && pgErr.Code == "23505" {
+			http.Error(w, "This item is already being auctioned", http.StatusConflict)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// From now on the item can only be bought by bidding. Carts holding it
+	// show it as removed.
+	_, err = tx.Exec(`
+		WITH declined AS (
+			UPDATE offers SET status = 'declined'
+			WHERE item_id = $1 AND status IN ('pending', 'accepted')
+			RETURNING id, buyer_id
+		)
+		INSERT INTO notifications (user_id, type, reference_id, message, read)
+		SELECT buyer_id, 'offer', id, $2, false FROM declined`,
+		req.ItemID, fmt.Sprintf("Your offer for %s was closed because the item is now up for auction", title))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var auction Auction
+	err = scanAuction(tx.QueryRow(`
+		SELECT `+auctionColumns+`
+		FROM auctions a
+		JOIN items i ON a.item_id = i.id
+		WHERE a.id = $1`, auctionID), &auction, userID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err = tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	sendJSON(w, auction)
+}
+
+// placeBidHandler bids on the auction ?id=. The bid must beat the highest
+// bid by at least the increment, or match the starting price if it is the
+// first. The bidder's address is kept for the order if they win.
+func placeBidHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, _ := getUserIDFromContext(r.Context())
+	auctionID := r.URL.Query().Get("id")
+	if _, err := uuid.Parse(auctionID); err != nil {
+		http.Error(w, "Auction not found", http.StatusNotFound)
+		return
+	}
+
+	var req struct {
+		Amount    float64 `json:"amount"`
+		AddressID string  `json:"address_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ok, err := ownsAddress(db, userID, req.AddressID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		http.Error(w, "address_id must be one of your addresses", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var auction Auction
+	err = scanAuction(tx.QueryRow(`
+		SELECT `+auctionColumns+`
+		FROM auctions a
+		JOIN items i ON a.item_id = i.id
+		WHERE a.id = $1 AND i.deleted_at IS NULL
+		FOR UPDATE OF a, i`, auctionID), &auction, userID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Auction not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if auction.Status != "open" || !auction.EndsAt.After(time.Now()) {
+		http.Error(w, "Auction has ended", http.StatusBadRequest)
+		return
+	}
+	if auction.SellerID == userID {
+		http.Error(w, "Cannot bid on your own item", http.StatusBadRequest)
+		return
+	}
+	if req.Amount < auction.MinimumBid || req.Amount >= 1e8 {
+		http.Error(w, fmt.Sprintf("Bid must be at least %.2f", auction.MinimumBid), http.StatusBadRequest)
+		return
+	}
+
+	var leaderID string
+	err = tx.QueryRow(`
+		SELECT bidder_id FROM auction_bids
+		WHERE auction_id = $1
+		ORDER BY amount DESC, created_at
+		LIMIT 1`,
+		auctionID).Scan(&leaderID)
+	if err != nil && err != sql.ErrNoRows {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO auction_bids (auction_id, bidder_id, address_id, amount)
+		VALUES ($1, $2, $3, $4)`,
+		auctionID, userID, req.AddressID, req.Amount)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if time.Until(auction.EndsAt) < auctionSnipeWindow {
+		_, err = tx.Exec(`
+			UPDATE auctions SET ends_at = GREATEST(ends_at, $1)
+			WHERE id = $2`,
+			time.Now().Add(auctionExtension), auctionID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if leaderID != "" && leaderID != userID {
+		err = createNotification(tx, leaderID, "auction", auctionID,
+			fmt.Sprintf("You have been outbid on %s: the highest bid is now %.2f", auction.ItemTitle, req.Amount))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	err = scanAuction(tx.QueryRow(`
+		SELECT `+auctionColumns+`
+		FROM auctions a
+		JOIN items i ON a.item_id = i.id
+		WHERE a.id = $1`, auctionID), &auction, userID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err = tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	sendJSON(w, auction)
+}
+
+// auctionBidsHandler returns the bid history of the auction ?id=, highest
+// bid first
+func auctionBidsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	auctionID := r.URL.Query().Get("id")
+	if _, err := uuid.Parse(auctionID); err != nil {
+		http.Error(w, "Auction not found", http.StatusNotFound)
+		return
+	}
+
+	var exists bool
+	err := db.QueryRow(`SELECT EXISTS (SELECT 1 FROM auctions WHERE id = $1)`, auctionID).Scan(&exists)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !exists {
+		http.Error(w, "Auction not found", http.StatusNotFound)
+		return
+	}
+
+	rows, err := db.Query(`
+		SELECT b.id, u.name, b.amount, b.created_at
+		FROM auction_bids b
+		JOIN users u ON b.bidder_id = u.id
+		WHERE b.auction_id = $1
+		ORDER BY b.amount DESC, b.created_at`,
+		auctionID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	bids := make([]AuctionBid, 0)
+	for rows.Next() {
+		var bid AuctionBid
+		if err := rows.Scan(&bid.ID, &bid.BidderName, &bid.Amount, &bid.CreatedAt); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		bids = append(bids, bid)
+	}
+
+	sendJSON(w, bids)
+}
+
+// closeAuctions settles every auction past its end. Each runs in its own
+// transaction so one failure does not hold up the rest.
+func closeAuctions() (int, error) {
+	rows, err := db.Query(`
+		SELECT id FROM auctions
+		WHERE status = 'open' AND ends_at <= CURRENT_TIMESTAMP`)
+	if err != nil {
+		return 0, err
+	}
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	closed := 0
+	for _, id := range ids {
+		if err := closeAuction(id); err != nil {
+			log.Printf("Error closing auction %s: %v", id, err)
+			continue
+		}
+		closed++
+	}
+	return closed, nil
+}
+
+// closeAuction sells the item to the highest bidder if the reserve was met
+// and the item is still available, creating their order at the winning bid
+func closeAuction(auctionID string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var itemID, sellerID, title string
+	var reserve sql.NullFloat64
+	var available bool
+	err = tx.QueryRow(`
+		SELECT a.item_id, i.seller_id, i.title, a.reserve_price,
+			   i.status = 'available' AND i.quantity > 0 AND i.deleted_at IS NULL
+		FROM auctions a
+		JOIN items i ON a.item_id = i.id
+		WHERE a.id = $1 AND a.status = 'open' AND a.ends_at <= CURRENT_TIMESTAMP
+		FOR UPDATE OF a, i`,
+		auctionID).Scan(&itemID, &sellerID, &title, &reserve, &available)
+	if err == sql.ErrNoRows {
+		// Extended by a late bid or closed by another run
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var winnerID, addressID string
+	var amount float64
+	err = tx.QueryRow(`
+		SELECT bidder_id, address_id, amount FROM auction_bids
+		WHERE auction_id = $1
+		ORDER BY amount DESC, created_at
+		LIMIT 1`,
+		auctionID).Scan(&winnerID, &addressID, &amount)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	hasBid := err == nil
+
+	if !hasBid || (reserve.Valid && amount < reserve.Float64) || !available {
+		_, err = tx.Exec(`UPDATE auctions SET status = 'unsold' WHERE id = $1`, auctionID)
+		if err != nil {
+			return err
+		}
+
+		message := fmt.Sprintf("Your auction for %s ended without bids", title)
+		if hasBid && !available {
+			message = fmt.Sprintf("Your auction for %s ended but the item was no longer available", title)
+		} else if hasBid {
+			message = fmt.Sprintf("Your auction for %s ended below the reserve at %.2f", title, amount)
+		}
+		if err := createNotification(tx, sellerID, "auction", auctionID, message); err != nil {
+			return err
+		}
+		if hasBid {
+			err = createNotification(tx, winnerID, "auction", auctionID,
+				fmt.Sprintf("The auction for %s ended without a sale", title))
+			if err != nil {
+				return err
+			}
+		}
+		return tx.Commit()
+	}
+
+	var orderID string
+	err = tx.QueryRow(`
+		INSERT INTO orders (user_id, address_id, total, status)
+		VALUES ($1, $2, $3, 'pending')
+		RETURNING id`,
+		winnerID, addressID, amount).Scan(&orderID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO order_items (order_id, item_id, price_at_time)
+		VALUES ($1, $2, $3)`,
+		orderID, itemID, amount)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
+		UPDATE items
+		SET quantity = quantity - 1,
+			status = CASE
+					WHEN quantity - 1 <= 0 THEN 'sold'::item_status_enum
+					ELSE status
+			END
+		WHERE id = $1`,
+		itemID)
+	if err != nil {
+		return err
+	}
+
+	if err := sellBundleStock(tx, orderID); err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
+		UPDATE auctions SET status = 'sold', order_id = $1
+		WHERE id = $2`,
+		orderID, auctionID)
+	if err != nil {
+		return err
+	}
+
+	err = createNotification(tx, winnerID, "auction", auctionID,
+		fmt.Sprintf("You won %s for %.2f. Follow up through order #%s", title, amount, orderID))
+	if err != nil {
+		return err
+	}
+
+	err = createNotification(tx, sellerID, "order_status", orderID,
+		fmt.Sprintf("New order #%s: %s sold at auction for %.2f", orderID, title, amount))
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func startAuctionCloser(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		n, err := closeAuctions()
+		if err != nil {
+			log.Printf("Error closing auctions: %v", err)
+			continue
+		}
+		if n > 0 {
+			log.Printf("Closed %d auctions", n)
+		}
+	}
+}
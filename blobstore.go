@@ -0,0 +1,493 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// BlobStore stores item images. Keys are the relative paths kept in
+// item_images.image_path, e.g. uploads/<uuid>.jpg, so rows stay valid when
+// images move between backends.
+type BlobStore interface {
+	Put(key string, r io.Reader, contentType string) error
+	Open(key string) (io.ReadCloser, error)
+	Stat(key string) (BlobInfo, error)
+	Delete(key string) error
+	// List returns every blob whose key starts with prefix
+	List(prefix string) ([]BlobInfo, error)
+	// SignedURL returns a time-limited URL clients can fetch the blob from
+	// directly, or errSignedURLUnsupported if the store cannot provide one.
+	SignedURL(key string, expiry time.Duration) (string, error)
+}
+
+type BlobInfo struct {
+	Key         string
+	Size        int64
+	ModTime     time.Time
+	ContentType string
+}
+
+var (
+	errBlobNotFound         = errors.New("blob not found")
+	errSignedURLUnsupported = errors.New("signed URLs not supported")
+)
+
+var blobs BlobStore
+
+// newBlobStore builds the store named by kind from environment settings:
+// BLOB_STORE_ROOT for local, and S3_ENDPOINT, S3_BUCKET, S3_REGION,
+// S3_ACCESS_KEY, S3_SECRET_KEY and S3_PATH_STYLE for s3.
+func newBlobStore(kind string) (BlobStore, error) {
+	switch kind {
+	case "", "local":
+		root := os.Getenv("BLOB_STORE_ROOT")
+		if root == "" {
+			root = "."
+		}
+		return &LocalBlobStore{Root: root}, nil
+	case "s3":
+		store := &S3BlobStore{
+			Endpoint:  strings.TrimSuffix(os.Getenv("S3_ENDPOINT"), "/"),
+			Bucket:    os.Getenv("S3_BUCKET"),
+			Region:    os.Getenv("S3_REGION"),
+			AccessKey: os.Getenv("S3_ACCESS_KEY"),
+			SecretKey: os.Getenv("S3_SECRET_KEY"),
+			PathStyle: os.Getenv("S3_PATH_STYLE") == "true",
+			Client:    &http.Client{Timeout: 30 * time.Second},
+		}
+		if store.Region == "" {
+			store.Region = "us-east-1"
+		}
+		if store.Endpoint == "" || store.Bucket == "" || store.AccessKey == "" || store.SecretKey == "" {
+			return nil, fmt.Errorf("S3_ENDPOINT, S3_BUCKET, S3_ACCESS_KEY and S3_SECRET_KEY are required")
+		}
+		return store, nil
+	default:
+		return nil, fmt.Errorf("unknown blob store: %q", kind)
+	}
+}
+
+func initBlobStore() {
+	var err error
+	blobs, err = newBlobStore(os.Getenv("BLOB_STORE"))
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// LocalBlobStore keeps blobs as files below Root
+type LocalBlobStore struct {
+	Root string
+}
+
+func (s *LocalBlobStore) path(key string) (string, error) {
+	if !filepath.IsLocal(key) {
+		return "", fmt.Errorf("invalid blob key: %q", key)
+	}
+	return filepath.Join(s.Root, key), nil
+}
+
+func (s *LocalBlobStore) Put(key string, r io.Reader, contentType string) error {
+	fullPath, err := s.path(key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(fullPath), 0755); err != nil {
+		return err
+	}
+
+	dst, err := os.Create(fullPath)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(dst, r); err != nil {
+		dst.Close()
+		os.Remove(fullPath)
+		return err
+	}
+	return dst.Close()
+}
+
+// Open returns an *os.File, which callers may use as an io.ReadSeeker
+func (s *LocalBlobStore) Open(key string) (io.ReadCloser, error) {
+	fullPath, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(fullPath)
+	if os.IsNotExist(err) {
+		return nil, errBlobNotFound
+	}
+	return f, err
+}
+
+func (s *LocalBlobStore) Stat(key string) (BlobInfo, error) {
+	fullPath, err := s.path(key)
+	if err != nil {
+		return BlobInfo{}, err
+	}
+
+	fi, err := os.Stat(fullPath)
+	if os.IsNotExist(err) {
+		return BlobInfo{}, errBlobNotFound
+	}
+	if err != nil {
+		return BlobInfo{}, err
+	}
+	return BlobInfo{Key: key, Size: fi.Size(), ModTime: fi.ModTime()}, nil
+}
+
+func (s *LocalBlobStore) Delete(key string) error {
+	fullPath, err := s.path(key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(fullPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (s *LocalBlobStore) List(prefix string) ([]BlobInfo, error) {
+	dir, err := s.path(filepath.Dir(prefix + "x"))
+	if err != nil {
+		return nil, err
+	}
+
+	var blobList []BlobInfo
+	err = filepath.WalkDir(dir, func(fullPath string, d fs.DirEntry, err error) error {
+		if os.IsNotExist(err) && fullPath == dir {
+			return filepath.SkipDir
+		}
+		if err != nil || d.IsDir() {
+			return err
+		}
+
+		rel, err := filepath.Rel(s.Root, fullPath)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		blobList = append(blobList, BlobInfo{Key: key, Size: fi.Size(), ModTime: fi.ModTime()})
+		return nil
+	})
+	return blobList, err
+}
+
+func (s *LocalBlobStore) SignedURL(key string, expiry time.Duration) (string, error) {
+	return "", errSignedURLUnsupported
+}
+
+// S3BlobStore talks to any S3-compatible service (AWS S3, MinIO, ...)
+// using AWS Signature Version 4.
+type S3BlobStore struct {
+	Endpoint  string // e.g. https://s3.eu-west-1.amazonaws.com or http://localhost:9000
+	Bucket    string
+	Region    string
+	AccessKey string
+	SecretKey string
+	PathStyle bool // address buckets as endpoint/bucket instead of bucket.endpoint
+	Client    *http.Client
+}
+
+const emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+func (s *S3BlobStore) objectURL(key string) (*url.URL, error) {
+	u, err := url.Parse(s.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	objectPath := "/" + strings.TrimPrefix(key, "/")
+	if s.PathStyle {
+		objectPath = "/" + s.Bucket + objectPath
+	} else {
+		u.Host = s.Bucket + "." + u.Host
+	}
+
+	u.Path = objectPath
+	u.RawPath = s3URIEncode(objectPath, false)
+	return u, nil
+}
+
+func (s *S3BlobStore) do(method, key string, query map[string]string, body []byte, contentType string) (*http.Response, error) {
+	u, err := s.objectURL(key)
+	if err != nil {
+		return nil, err
+	}
+	u.RawQuery = s3CanonicalQuery(query)
+
+	payloadHash := emptyPayloadHash
+	if body != nil {
+		sum := sha256.Sum256(body)
+		payloadHash = hex.EncodeToString(sum[:])
+	}
+
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	s.sign(req, payloadHash, time.Now().UTC())
+
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, errBlobNotFound
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		defer resp.Body.Close()
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("s3 %s %s: %s: %s", method, key, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return resp, nil
+}
+
+func (s *S3BlobStore) Put(key string, r io.Reader, contentType string) error {
+	body, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	resp, err := s.do(http.MethodPut, key, nil, body, contentType)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func (s *S3BlobStore) Open(key string) (io.ReadCloser, error) {
+	resp, err := s.do(http.MethodGet, key, nil, nil, "")
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (s *S3BlobStore) Stat(key string) (BlobInfo, error) {
+	resp, err := s.do(http.MethodHead, key, nil, nil, "")
+	if err != nil {
+		return BlobInfo{}, err
+	}
+	resp.Body.Close()
+
+	info := BlobInfo{Key: key, Size: resp.ContentLength, ContentType: resp.Header.Get("Content-Type")}
+	info.ModTime, _ = http.ParseTime(resp.Header.Get("Last-Modified"))
+	return info, nil
+}
+
+func (s *S3BlobStore) Delete(key string) error {
+	resp, err := s.do(http.MethodDelete, key, nil, nil, "")
+	if err == errBlobNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// List pages through ListObjectsV2 results for prefix
+func (s *S3BlobStore) List(prefix string) ([]BlobInfo, error) {
+	var blobList []BlobInfo
+	query := map[string]string{"list-type": "2", "prefix": prefix}
+
+	for {
+		resp, err := s.do(http.MethodGet, "", query, nil, "")
+		if err != nil {
+			return nil, err
+		}
+
+		var result struct {
+			Contents []struct {
+				Key          string    `xml:"Key"`
+				LastModified time.Time `xml:"LastModified"`
+				Size         int64     `xml:"Size"`
+			} `xml:"Contents"`
+			IsTruncated           bool   `xml:"IsTruncated"`
+			NextContinuationToken string `xml:"NextContinuationToken"`
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, obj := range result.Contents {
+			blobList = append(blobList, BlobInfo{Key: obj.Key, Size: obj.Size, ModTime: obj.LastModified})
+		}
+
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return blobList, nil
+		}
+		query["continuation-token"] = result.NextContinuationToken
+	}
+}
+
+// SignedURL returns a presigned GET URL valid for expiry (at most 7 days)
+func (s *S3BlobStore) SignedURL(key string, expiry time.Duration) (string, error) {
+	return s.presign(key, expiry, time.Now().UTC())
+}
+
+func (s *S3BlobStore) presign(key string, expiry time.Duration, now time.Time) (string, error) {
+	u, err := s.objectURL(key)
+	if err != nil {
+		return "", err
+	}
+
+	amzDate := now.Format("20060102T150405Z")
+	scope := s.scope(now)
+
+	query := map[string]string{
+		"X-Amz-Algorithm":     "AWS4-HMAC-SHA256",
+		"X-Amz-Credential":    s.AccessKey + "/" + scope,
+		"X-Amz-Date":          amzDate,
+		"X-Amz-Expires":       strconv.Itoa(int(expiry.Seconds())),
+		"X-Amz-SignedHeaders": "host",
+	}
+	canonicalQuery := s3CanonicalQuery(query)
+
+	canonicalRequest := strings.Join([]string{
+		http.MethodGet,
+		u.EscapedPath(),
+		canonicalQuery,
+		"host:" + u.Host + "\n",
+		"host",
+		"UNSIGNED-PAYLOAD",
+	}, "\n")
+
+	signature := s.signature(now, amzDate, scope, canonicalRequest)
+	u.RawQuery = canonicalQuery + "&X-Amz-Signature=" + signature
+	return u.String(), nil
+}
+
+func (s *S3BlobStore) sign(req *http.Request, payloadHash string, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	scope := s.scope(now)
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{
+		"host":                 req.URL.Host,
+		"x-amz-content-sha256": payloadHash,
+		"x-amz-date":           amzDate,
+	}
+	if ct := req.Header.Get("Content-Type"); ct != "" {
+		headers["content-type"] = ct
+	}
+
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + strings.TrimSpace(headers[name]) + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	signature := s.signature(now, amzDate, scope, canonicalRequest)
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.AccessKey, scope, signedHeaders, signature))
+}
+
+func (s *S3BlobStore) scope(now time.Time) string {
+	return now.Format("20060102") + "/" + s.Region + "/s3/aws4_request"
+}
+
+func (s *S3BlobStore) signature(now time.Time, amzDate, scope, canonicalRequest string) string {
+	hashed := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hashed[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.SecretKey), now.Format("20060102"))
+	key = hmacSHA256(key, s.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	return hex.EncodeToString(hmacSHA256(key, stringToSign))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3URIEncode percent-encodes everything except unreserved characters, as
+// required by Signature Version 4. Slashes are kept when encoding paths.
+func s3URIEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c >= 'A' && c <= 'Z', c >= 'a' && c <= 'z', c >= '0' && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func s3CanonicalQuery(params map[string]string) string {
+	keys := make([]string, 0, len(params))
+	for k := range params {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		parts = append(parts, s3URIEncode(k, true)+"="+s3URIEncode(params[k], true))
+	}
+	return strings.Join(parts, "&")
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+const (
+	minBundleItems = 2
+	maxBundleItems = 50
+)
+
+// A bundle is a listing of its own, with its own price and photos, that
+// groups other listings of the same seller. The grouped listings can still
+// be bought on their own, so selling either side affects the other's stock.
+
+// bundleItemIDsSQL lists the items grouped by a bundle i, or an empty
+// array for regular listings
+const bundleItemIDsSQL = `ARRAY(SELECT b.item_id::text FROM bundle_items b WHERE b.bundle_id = i.id ORDER BY b.item_id)`
+
+// multibuyPercentSQL is the multi-buy discount in percent the seller of
+// item i gives on cart c, or 0 if the cart holds too few of their items
+const multibuyPercentSQL = `COALESCE((
+		SELECT md.percent_off FROM multibuy_discounts md
+		WHERE md.seller_id = i.seller_id
+		AND md.min_items <= (
+			SELECT COUNT(*) FROM cart_items c2
+			JOIN items i2 ON c2.item_id = i2.id
+			WHERE c2.user_id = c.user_id AND i2.seller_id = i.seller_id)), 0)`
+
+// cartLinePriceSQL is what the buyer pays for item i in cart c: the listed
+// or offered price less any multi-buy discount
+const cartLinePriceSQL = `ROUND(` + cartPriceSQL + ` * (1 - ` + multibuyPercentSQL + ` / 100), 2)`
+
+// addBundleItems groups the seller's listings under a new bundle. It
+// returns an error meant for the seller if any of them cannot be bundled.
+func addBundleItems(tx *sql.Tx, bundleID, sellerID string, itemIDs []string) (userErr string, err error) {
+	seen := make(map[string]bool)
+	var unique []string
+	for _, id := range itemIDs {
+		if _, err := uuid.Parse(id); err != nil {
+			return fmt.Sprintf("invalid bundle item id: %q", id), nil
+		}
+		if !seen[id] {
+			seen[id] = true
+			unique = append(unique, id)
+		}
+	}
+	if len(unique) < minBundleItems || len(unique) > maxBundleItems {
+		return fmt.Sprintf("a bundle must group between %d and %d items", minBundleItems, maxBundleItems), nil
+	}
+
+	// Bundles cannot be nested, and sold items cannot be sold again
+	result, err := tx.Exec(`
+		INSERT INTO bundle_items (bundle_id, item_id)
+		SELECT $1, i.id FROM items i
+		WHERE i.id = ANY($2) AND i.seller_id = $3 AND i.deleted_at IS NULL
+		AND i.status <> 'sold' AND i.quantity > 0
+		AND NOT EXISTS (SELECT 1 FROM bundle_items b WHERE b.bundle_id = i.id)`,
+		bundleID, pq.Array(unique), sellerID)
+	if err != nil {
+		return "", err
+	}
+	if n, _ := result.RowsAffected(); n != int64(len(unique)) {
+		return "bundle items must be your own unsold listings and not bundles themselves", nil
+	}
+	return "", nil
+}
+
+// cartConflict reports whether adding an item would put the same piece of
+// clothing in the cart twice, either as a bundle and one of its items or
+// as two bundles sharing an item.
+func cartConflict(tx *sql.Tx, userID, itemID string) (bool, error) {
+	var conflict bool
+	err := tx.QueryRow(`
+		WITH covered AS (
+			SELECT c.item_id AS id FROM cart_items c WHERE c.user_id = $1
+			UNION
+			SELECT b.item_id FROM cart_items c
+			JOIN bundle_items b ON b.bundle_id = c.item_id
+			WHERE c.user_id = $1
+		)
+		SELECT EXISTS (
+			SELECT 1 FROM covered
+			WHERE id = $2
+			OR id IN (SELECT item_id FROM bundle_items WHERE bundle_id = $2)
+		)`,
+		userID, itemID).Scan(&conflict)
+	return conflict, err
+}
+
+// sellBundleStock applies the bundle side of an order to stock: the items
+// of a sold bundle are sold with it, and bundles that lost an item to this
+// order can no longer be bought.
+func sellBundleStock(tx *sql.Tx, orderID string) error {
+	_, err := tx.Exec(`
+		UPDATE items i
+		SET quantity = i.quantity - (
+				SELECT COUNT(*) FROM bundle_items b
+				JOIN order_items oi ON oi.item_id = b.bundle_id
+				WHERE oi.order_id = $1 AND b.item_id = i.id),
+			status = CASE
+					WHEN i.quantity - (
+						SELECT COUNT(*) FROM bundle_items b
+						JOIN order_items oi ON oi.item_id = b.bundle_id
+						WHERE oi.order_id = $1 AND b.item_id = i.id) <= 0 THEN 'sold'::item_status_enum
+					ELSE i.status
+			END
+		WHERE i.id IN (
+			SELECT b.item_id FROM bundle_items b
+			JOIN order_items oi ON oi.item_id = b.bundle_id
+			WHERE oi.order_id = $1)`,
+		orderID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
+		UPDATE items bundle
+		SET quantity = 0, status = 'sold'::item_status_enum
+		WHERE bundle.status <> 'sold'
+		AND EXISTS (
+			SELECT 1 FROM bundle_items b
+			JOIN items component ON component.id = b.item_id
+			WHERE b.bundle_id = bundle.id AND component.quantity <= 0
+			AND component.id IN (
+				SELECT item_id FROM order_items WHERE order_id = $1
+				UNION
+				SELECT b2.item_id FROM bundle_items b2
+				JOIN order_items oi ON oi.item_id = b2.bundle_id
+				WHERE oi.order_id = $1))`,
+		orderID)
+	return err
+}
+
+// restockBundles undoes sellBundleStock for a cancelled order whose own
+// items were already put back. It returns the items that went from sold
+// to available.
+func restockBundles(tx *sql.Tx, orderID string) ([]string, error) {
+	var restocked []string
+	collect := func(rows *sql.Rows, err error) error {
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var id string
+			if err := rows.Scan(&id); err != nil {
+				return err
+			}
+			restocked = append(restocked, id)
+		}
+		return rows.Err()
+	}
+
+	// Items sold as part of a cancelled bundle
+	err := collect(tx.Query(`
+		WITH updated AS (
+			UPDATE items i
+			SET quantity = i.quantity + (
+					SELECT COUNT(*) FROM bundle_items b
+					JOIN order_items oi ON oi.item_id = b.bundle_id
+					WHERE oi.order_id = $1 AND b.item_id = i.id),
+				status = CASE
+						WHEN i.status = 'sold' AND i.deleted_at IS NULL THEN 'available'::item_status_enum
+						ELSE i.status
+				END
+			FROM items prev
+			WHERE prev.id = i.id
+			AND i.id IN (
+				SELECT b.item_id FROM bundle_items b
+				JOIN order_items oi ON oi.item_id = b.bundle_id
+				WHERE oi.order_id = $1)
+			RETURNING i.id, i.status, prev.status AS previous_status
+		)
+		SELECT id FROM updated WHERE previous_status = 'sold' AND status = 'available'`,
+		orderID))
+	if err != nil {
+		return nil, err
+	}
+
+	// Bundles that were withdrawn because an item sold, once all of their
+	// items are back and the bundle itself is not part of a live order
+	err = collect(tx.Query(`
+		UPDATE items bundle
+		SET quantity = 1, status = 'available'::item_status_enum
+		WHERE bundle.status = 'sold' AND bundle.deleted_at IS NULL
+		AND EXISTS (SELECT 1 FROM bundle_items b WHERE b.bundle_id = bundle.id)
+		AND NOT EXISTS (
+			SELECT 1 FROM bundle_items b
+			JOIN items component ON component.id = b.item_id
+			WHERE b.bundle_id = bundle.id
+			AND (component.quantity <= 0 OR component.status <> 'available'
+				OR component.deleted_at IS NOT NULL))
+		AND NOT EXISTS (
+			SELECT 1 FROM order_items oi
+			JOIN orders o ON oi.order_id = o.id
+			WHERE oi.item_id = bundle.id AND o.status <> 'cancelled')
+		AND bundle.id IN (
+			SELECT b.bundle_id FROM bundle_items b
+			WHERE b.item_id IN (
+				SELECT item_id FROM order_items WHERE order_id = $1
+				UNION
+				SELECT b2.item_id FROM bundle_items b2
+				JOIN order_items oi ON oi.item_id = b2.bundle_id
+				WHERE oi.order_id = $1))
+		RETURNING bundle.id`,
+		orderID))
+	if err != nil {
+		return nil, err
+	}
+
+	return restocked, nil
+}
+
+// MultibuyDiscount takes PercentOff off every item of a seller in a cart
+// holding at least MinItems of their items
+type MultibuyDiscount struct {
+	MinItems   int       `json:"min_items"`
+	PercentOff float64   `json:"percent_off"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+func multibuyDiscountHandler(w http.ResponseWriter, r *http.Request) {
+	userID, _ := getUserIDFromContext(r.Context())
+
+	switch r.Method {
+	case http.MethodGet:
+		var d MultibuyDiscount
+		err := db.QueryRow(`
+			SELECT min_items, percent_off, updated_at
+			FROM multibuy_discounts
+			WHERE seller_id = $1`,
+			userID).Scan(&d.MinItems, &d.PercentOff, &d.UpdatedAt)
+
+		if err == sql.ErrNoRows {
+			sendJSON(w, nil)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		sendJSON(w, d)
+
+	case http.MethodPut:
+		var d MultibuyDiscount
+		if err := json.NewDecoder(r.Body).Decode(&d); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if d.MinItems < 2 {
+			http.Error(w, "min_items must be at least 2", http.StatusBadRequest)
+			return
+		}
+		if d.PercentOff <= 0 || d.PercentOff > 90 {
+			http.Error(w, "percent_off must be greater than 0 and at most 90", http.StatusBadRequest)
+			return
+		}
+
+		err := db.QueryRow(`
+			INSERT INTO multibuy_discounts (seller_id, min_items, percent_off)
+			VALUES ($1, $2, $3)
+			ON CONFLICT (seller_id) DO UPDATE
+			SET min_items = EXCLUDED.min_items,
+				percent_off = EXCLUDED.percent_off,
+				updated_at = CURRENT_TIMESTAMP
+			RETURNING percent_off, updated_at`,
+			userID, d.MinItems, d.PercentOff).Scan(&d.PercentOff, &d.UpdatedAt)
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		sendJSON(w, d)
+
+	case http.MethodDelete:
+		_, err := db.Exec(`DELETE FROM multibuy_discounts WHERE seller_id = $1`, userID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+const defaultCartExpiryDays = 30
+
+// cartExpiry is how long a cart may go untouched before the pruner empties
+// it. Adding, removing, viewing and accepting a new price all count.
+// CART_EXPIRY_DAYS overrides the default.
+var cartExpiry = defaultCartExpiryDays * 24 * time.Hour
+
+func initCartExpiry() {
+	value := os.Getenv("CART_EXPIRY_DAYS")
+	if value == "" {
+		return
+	}
+	days, err := strconv.Atoi(value)
+	if err != nil || days < 1 {
+		log.Fatalf("CART_EXPIRY_DAYS must be a positive number of days, got %q", value)
+	}
+	cartExpiry = time.Duration(days) * 24 * time.Hour
+}
+
+// cartLineStatusSQL tells the buyer what happened to item i since it was
+// put in cart c: removed from sale, sold out, repriced, or available as it
+// was. Items put up for auction, or bundles with such an item, count as
+// removed. Lines added before prices were recorded never show a change.
+const cartLineStatusSQL = `CASE
+			WHEN i.deleted_at IS NOT NULL THEN 'removed'
+			WHEN i.status IN ('sold', 'reserved') OR i.quantity <= 0 THEN 'sold'
+			WHEN i.status <> 'available' THEN 'removed'
+			WHEN EXISTS (
+				SELECT 1 FROM auctions a
+				WHERE a.status = 'open'
+				AND (a.item_id = i.id
+					OR a.item_id IN (SELECT b.item_id FROM bundle_items b WHERE b.bundle_id = i.id))) THEN 'removed'
+			WHEN c.price_at_add IS NOT NULL AND i.price <> c.price_at_add THEN 'price_changed'
+			ELSE 'available'
+		END`
+
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// touchCart records activity on the user's cart so it is not pruned
+func touchCart(e execer, userID string) error {
+	_, err := e.Exec(`UPDATE cart_items SET touched_at = CURRENT_TIMESTAMP WHERE user_id = $1`, userID)
+	return err
+}
+
+// lockCartItems locks the items a checkout of the user's cart would sell,
+// including the items of bundles, so concurrent checkouts cannot both pass
+// the availability check. Rows are locked in id order to avoid deadlocks.
+func lockCartItems(tx *sql.Tx, userID string) error {
+	_, err := tx.Exec(`
+		SELECT i.id FROM items i
+		WHERE i.id IN (
+			SELECT c.item_id FROM cart_items c WHERE c.user_id = $1
+			UNION
+			SELECT b.item_id FROM cart_items c
+			JOIN bundle_items b ON b.bundle_id = c.item_id
+			WHERE c.user_id = $1)
+		ORDER BY i.id
+		FOR UPDATE`,
+		userID)
+	return err
+}
+
+// acceptCartPriceHandler clears a price change warning by taking the
+// current listed price of a cart item as the one the buyer agreed to
+func acceptCartPriceHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, _ := getUserIDFromContext(r.Context())
+
+	var req struct {
+		ItemID string `json:"item_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	result, err := db.Exec(`
+		UPDATE cart_items c
+		SET price_at_add = i.price
+		FROM items i
+		WHERE i.id = c.item_id AND c.user_id = $1 AND c.item_id = $2`,
+		userID, req.ItemID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		http.Error(w, "Item not in cart", http.StatusNotFound)
+		return
+	}
+
+	viewCartHandler(w, r)
+}
+
+// pruneStaleCarts empties carts nobody touched within cartExpiry. Every
+// touch updates all lines of a cart, so old lines mean an idle cart.
+func pruneStaleCarts() (int64, error) {
+	result, err := db.Exec(`DELETE FROM cart_items WHERE touched_at < $1`, time.Now().Add(-cartExpiry))
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func startCartPruner(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		n, err := pruneStaleCarts()
+		if err != nil {
+			log.Printf("Error pruning stale carts: %v", err)
+			continue
+		}
+		if n > 0 {
+			log.Printf("Pruned %d items from stale carts", n)
+		}
+	}
+}
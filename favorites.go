@@ -0,0 +1,230 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// favoritesCountSQL counts how many users saved an item i. It is selected
+// alongside the item columns wherever listings are shown.
+const favoritesCountSQL = `(SELECT COUNT(*) FROM favorites f WHERE f.item_id = i.id)`
+
+// Favorite is an item a user saved for later. With Notify set the user is
+// told when the price drops or the item is back in stock.
+type Favorite struct {
+	ID        string    `json:"id"`
+	Notify    bool      `json:"notify"`
+	CreatedAt time.Time `json:"created_at"`
+	Item      Item      `json:"item"`
+}
+
+func favoritesHandler(w http.ResponseWriter, r *http.Request) {
+	userID, _ := getUserIDFromContext(r.Context())
+
+	switch r.Method {
+	case http.MethodGet:
+		listFavorites(w, r, userID)
+
+	case http.MethodPost:
+		var req struct {
+			ItemID string `json:"item_id"`
+			Notify *bool  `json:"notify"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		notify := req.Notify == nil || *req.Notify
+
+		var sellerID string
+		err := db.QueryRow(`SELECT seller_id FROM items WHERE id = $1 AND deleted_at IS NULL`, req.ItemID).Scan(&sellerID)
+		if err == sql.ErrNoRows {
+			http.Error(w, "Item not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if sellerID == userID {
+			http.Error(w, "Cannot favorite your own item", http.StatusBadRequest)
+			return
+		}
+
+		// Favoriting twice keeps the original entry
+		var fav Favorite
+		err = db.QueryRow(`
+			INSERT INTO favorites (user_id, item_id, notify)
+			VALUES ($1, $2, $3)
+			ON CONFLICT (user_id, item_id) DO UPDATE SET notify = favorites.notify
+			RETURNING id, notify, created_at`,
+			userID, req.ItemID, notify).Scan(&fav.ID, &fav.Notify, &fav.CreatedAt)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		fav.Item, err = getItemByID(req.ItemID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		sendJSON(w, fav)
+
+	case http.MethodPut:
+		var req struct {
+			Notify bool `json:"notify"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		result, err := db.Exec(`
+			UPDATE favorites SET notify = $1
+			WHERE user_id = $2 AND item_id = $3`,
+			req.Notify, userID, r.URL.Query().Get("item_id"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			http.Error(w, "Favorite not found", http.StatusNotFound)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+
+	case http.MethodDelete:
+		result, err := db.Exec(`
+			DELETE FROM favorites
+			WHERE user_id = $1 AND item_id = $2`,
+			userID, r.URL.Query().Get("item_id"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			http.Error(w, "Favorite not found", http.StatusNotFound)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// listFavorites returns the user's favorites, most recently saved first.
+// Sold and paused items stay listed so their status can be followed;
+// deleted ones are hidden.
+func listFavorites(w http.ResponseWriter, r *http.Request, userID string) {
+	keys := newestFirstKeys("f")
+	page, err := parsePageRequest(r, "favorites", keys)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	filter := "f.user_id = $1 AND i.deleted_at IS NULL"
+	args := []interface{}{userID}
+
+	total, err := page.countTotal(`
+		SELECT COUNT(*) FROM favorites f
+		JOIN items i ON f.item_id = i.id
+		WHERE `+filter, args...)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if cond, pageArgs := page.where(keys, len(args)+1); cond != "" {
+		filter += " AND " + cond
+		args = append(args, pageArgs...)
+	}
+
+	rows, err := db.Query(`
+		SELECT f.id, f.notify, f.created_at,
+			   i.id, i.title, i.description, COALESCE(i.brand, ''), i.price, i.size, i.category,
+			   COALESCE(i.condition::text, ''), i.local_pickup, i.status, i.quantity, i.seller_id,
+			   u.name as seller_name, i.created_at, `+favoritesCountSQL+`,
+			   `+itemImagesSQL+`
+		FROM favorites f
+		JOIN items i ON f.item_id = i.id
+		JOIN users u ON i.seller_id = u.id
+		LEFT JOIN item_images im ON i.id = im.item_id
+		WHERE `+filter+`
+		GROUP BY f.id, i.id, u.name
+		ORDER BY `+orderByKeys(keys)+page.limitClause(),
+		args...)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	favorites := make([]Favorite, 0)
+	for rows.Next() {
+		var fav Favorite
+		var images, imageIDs []sql.NullString
+		item := &fav.Item
+		err := rows.Scan(&fav.ID, &fav.Notify, &fav.CreatedAt,
+			&item.ID, &item.Title, &item.Description, &item.Brand, &item.Price, &item.Size, &item.Category,
+			&item.Condition, &item.LocalPickup, &item.Status, &item.Quantity, &item.SellerID,
+			&item.SellerName, &item.CreatedAt, &item.FavoritesCount, pq.Array(&images), pq.Array(&imageIDs))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		setItemImages(item, images, imageIDs)
+
+		favorites = append(favorites, fav)
+	}
+
+	result := Page{Total: total}
+	if page.hasMore(len(favorites)) {
+		favorites = favorites[:page.limit]
+		last := favorites[len(favorites)-1]
+		result.NextCursor = page.nextCursor(keys, createdAtCursorValues(last.CreatedAt, last.ID))
+	}
+	result.Items = favorites
+
+	sendJSON(w, result)
+}
+
+// notifyFavoritesPriceDrop tells everyone watching an item that its price
+// went down. Callers only invoke it for live listings.
+func notifyFavoritesPriceDrop(tx *sql.Tx, itemID, title string, oldPrice, newPrice float64) error {
+	_, err := tx.Exec(`
+		INSERT INTO notifications (user_id, type, reference_id, message, read)
+		SELECT f.user_id, 'price_drop', f.item_id, $2, false
+		FROM favorites f
+		WHERE f.item_id = $1 AND f.notify`,
+		itemID, fmt.Sprintf("Price drop: %s is now %.2f (was %.2f)", title, newPrice, oldPrice))
+	return err
+}
+
+// notifyFavoritesBackInStock tells everyone watching the given items that
+// they can be bought again.
+func notifyFavoritesBackInStock(tx *sql.Tx, itemIDs []string) error {
+	if len(itemIDs) == 0 {
+		return nil
+	}
+	_, err := tx.Exec(`
+		INSERT INTO notifications (user_id, type, reference_id, message, read)
+		SELECT f.user_id, 'back_in_stock', i.id, 'Back in stock: ' || i.title, false
+		FROM favorites f
+		JOIN items i ON f.item_id = i.id
+		WHERE i.id = ANY($1) AND f.notify
+		AND i.status = 'available' AND i.deleted_at IS NULL`,
+		pq.Array(itemIDs))
+	return err
+}
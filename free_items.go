@@ -0,0 +1,484 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+// Free items are given away rather than sold. Interested users join a
+// queue of requests and the giver picks who gets the item, or with
+// first_come set the first eligible request wins straight away. Only then
+// is an order created, so shipping and messages work as for sales.
+const (
+	maxFreeClaimsPerWeek = 3
+	freeClaimPeriod      = 7 * 24 * time.Hour
+)
+
+type FreeItemRequest struct {
+	ID            string    `json:"id"`
+	ItemID        string    `json:"item_id"`
+	ItemTitle     string    `json:"item_title"`
+	RequesterID   string    `json:"requester_id"`
+	RequesterName string    `json:"requester_name"`
+	Message       string    `json:"message,omitempty"`
+	Status        string    `json:"status"`
+	OrderID       string    `json:"order_id,omitempty"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+const freeItemRequestColumns = `fr.id, fr.item_id, i.title, fr.requester_id, u.name, COALESCE(fr.message, ''),
+		fr.status, COALESCE(fr.order_id::text, ''), fr.created_at`
+
+func scanFreeItemRequest(row interface{ Scan(...interface{}) error }, req *FreeItemRequest) error {
+	return row.Scan(&req.ID, &req.ItemID, &req.ItemTitle, &req.RequesterID, &req.RequesterName,
+		&req.Message, &req.Status, &req.OrderID, &req.CreatedAt)
+}
+
+// recentFreeClaims counts the free items the user received in the last
+// claim period. It first locks the user's row so concurrent claims for the
+// same user are counted one after the other and cannot all pass the limit.
+func recentFreeClaims(tx *sql.Tx, userID string) (int, error) {
+	if _, err := tx.Exec(`SELECT 1 FROM users WHERE id = $1 FOR UPDATE`, userID); err != nil {
+		return 0, err
+	}
+
+	var n int
+	err := tx.QueryRow(`
+		SELECT COUNT(*) FROM free_item_requests
+		WHERE requester_id = $1 AND status = 'accepted' AND decided_at > $2`,
+		userID, time.Now().Add(-freeClaimPeriod)).Scan(&n)
+	return n, err
+}
+
+// freeItemRequestsHandler serves /items/{id}/requests: the giver lists the
+// queue of an item with GET and other users join it with POST.
+func freeItemRequestsHandler(w http.ResponseWriter, r *http.Request) {
+	userID, _ := getUserIDFromContext(r.Context())
+
+	itemID := strings.TrimPrefix(r.URL.Path, "/items/")
+	itemID = strings.TrimSuffix(itemID, "/requests")
+	if _, err := uuid.Parse(itemID); err != nil {
+		http.Error(w, "Item not found", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		listFreeItemRequests(w, itemID, userID)
+	case http.MethodPost:
+		requestFreeItem(w, r, itemID, userID)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// listFreeItemRequests returns the queue of an item in request order
+func listFreeItemRequests(w http.ResponseWriter, itemID, userID string) {
+	var sellerID string
+	err := db.QueryRow(`
+		SELECT seller_id FROM items
+		WHERE id = $1 AND is_free AND deleted_at IS NULL`,
+		itemID).Scan(&sellerID)
+	if err == sql.ErrNoRows || (err == nil && sellerID != userID) {
+		http.Error(w, "Item not found or not authorized", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	rows, err := db.Query(`
+		SELECT `+freeItemRequestColumns+`
+		FROM free_item_requests fr
+		JOIN items i ON fr.item_id = i.id
+		JOIN users u ON fr.requester_id = u.id
+		WHERE fr.item_id = $1
+		ORDER BY fr.created_at, fr.id`,
+		itemID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	requests := make([]FreeItemRequest, 0)
+	for rows.Next() {
+		var req FreeItemRequest
+		if err := scanFreeItemRequest(rows, &req); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		requests = append(requests, req)
+	}
+
+	sendJSON(w, requests)
+}
+
+func requestFreeItem(w http.ResponseWriter, r *http.Request, itemID, userID string) {
+	var body struct {
+		AddressID string `json:"address_id"`
+		Message   string `json:"message"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ok, err := ownsAddress(db, userID, body.AddressID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		http.Error(w, "address_id must be one of your addresses", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var sellerID, title string
+	var firstCome bool
+	err = tx.QueryRow(`
+		SELECT seller_id, title, free_first_come FROM items
+		WHERE id = $1 AND is_free AND status = 'available' AND quantity > 0 AND deleted_at IS NULL
+		FOR UPDATE`,
+		itemID).Scan(&sellerID, &title, &firstCome)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Item not found or no longer available", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if sellerID == userID {
+		http.Error(w, "Cannot request your own item", http.StatusBadRequest)
+		return
+	}
+
+	claims, err := recentFreeClaims(tx, userID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if claims >= maxFreeClaimsPerWeek {
+		http.Error(w, fmt.Sprintf("You can claim at most %d free items per week", maxFreeClaimsPerWeek), http.StatusTooManyRequests)
+		return
+	}
+
+	var requestID string
+	err = tx.QueryRow(`
+		INSERT INTO free_item_requests (item_id, requester_id, address_id, message)
+		VALUES ($1, $2, $3, NULLIF($4, ''))
+		RETURNING id`,
+		itemID, userID, body.AddressID, body.Message).Scan(&requestID)
+	if err != nil {
+		if pgErr, ok := err.(*pq.Error); ok && pgErr.Code == "23505" {
+			http.Error(w, "You already requested this item", http.StatusConflict)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if firstCome {
+		if _, err := acceptFreeItemRequest(tx, requestID); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	} else {
+		err = createNotification(tx, sellerID, "free_request", requestID, fmt.Sprintf("Someone would like your free item %s", title))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	var req FreeItemRequest
+	err = scanFreeItemRequest(tx.QueryRow(`
+		SELECT `+freeItemRequestColumns+`
+		FROM free_item_requests fr
+		JOIN items i ON fr.item_id = i.id
+		JOIN users u ON fr.requester_id = u.id
+		WHERE fr.id = $1`, requestID), &req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err = tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	sendJSON(w, req)
+}
+
+// freeRequestsHandler lets users list the free items they asked for and
+// withdraw a request, and lets givers accept or decline one.
+func freeRequestsHandler(w http.ResponseWriter, r *http.Request) {
+	userID, _ := getUserIDFromContext(r.Context())
+
+	switch r.Method {
+	case http.MethodGet:
+		rows, err := db.Query(`
+			SELECT `+freeItemRequestColumns+`
+			FROM free_item_requests fr
+			JOIN items i ON fr.item_id = i.id
+			JOIN users u ON fr.requester_id = u.id
+			WHERE fr.requester_id = $1
+			ORDER BY fr.created_at DESC, fr.id DESC`,
+			userID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		requests := make([]FreeItemRequest, 0)
+		for rows.Next() {
+			var req FreeItemRequest
+			if err := scanFreeItemRequest(rows, &req); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			requests = append(requests, req)
+		}
+
+		sendJSON(w, requests)
+
+	case http.MethodPut:
+		respondToFreeItemRequest(w, r, userID)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func respondToFreeItemRequest(w http.ResponseWriter, r *http.Request, userID string) {
+	requestID := r.URL.Query().Get("id")
+
+	var body struct {
+		Action string `json:"action"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var requesterID, sellerID, status, title string
+	err = tx.QueryRow(`
+		SELECT fr.requester_id, i.seller_id, fr.status, i.title
+		FROM free_item_requests fr
+		JOIN items i ON fr.item_id = i.id
+		WHERE fr.id = $1 AND (fr.requester_id = $2 OR i.seller_id = $2)
+		FOR UPDATE OF fr, i`,
+		requestID, userID).Scan(&requesterID, &sellerID, &status, &title)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Request not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if status != "pending" {
+		http.Error(w, "Request is no longer pending", http.StatusBadRequest)
+		return
+	}
+
+	switch body.Action {
+	case "accept":
+		if userID != sellerID {
+			http.Error(w, "Only the giver can accept a request", http.StatusForbidden)
+			return
+		}
+		claims, err := recentFreeClaims(tx, requesterID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if claims >= maxFreeClaimsPerWeek {
+			http.Error(w, "This user has reached their weekly limit of free items, pick someone else", http.StatusBadRequest)
+			return
+		}
+		available, err := acceptFreeItemRequest(tx, requestID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !available {
+			http.Error(w, "Item is no longer available", http.StatusBadRequest)
+			return
+		}
+
+	case "decline":
+		if userID != sellerID {
+			http.Error(w, "Only the giver can decline a request", http.StatusForbidden)
+			return
+		}
+		err = setFreeItemRequestStatus(tx, requestID, "declined")
+		if err == nil {
+			err = createNotification(tx, requesterID, "free_request", requestID,
+				fmt.Sprintf("Your request for %s was not picked this time", title))
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+	case "withdraw":
+		if userID != requesterID {
+			http.Error(w, "Only the requester can withdraw a request", http.StatusForbidden)
+			return
+		}
+		if err := setFreeItemRequestStatus(tx, requestID, "withdrawn"); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+	default:
+		http.Error(w, "action must be accept, decline or withdraw", http.StatusBadRequest)
+		return
+	}
+
+	var req FreeItemRequest
+	err = scanFreeItemRequest(tx.QueryRow(`
+		SELECT `+freeItemRequestColumns+`
+		FROM free_item_requests fr
+		JOIN items i ON fr.item_id = i.id
+		JOIN users u ON fr.requester_id = u.id
+		WHERE fr.id = $1`, requestID), &req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err = tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	sendJSON(w, req)
+}
+
+func setFreeItemRequestStatus(tx *sql.Tx, requestID, status string) error {
+	_, err := tx.Exec(`
+		UPDATE free_item_requests
+		SET status = $1::free_request_status_enum, decided_at = CURRENT_TIMESTAMP
+		WHERE id = $2`,
+		status, requestID)
+	return err
+}
+
+// acceptFreeItemRequest gives the item to the requester: it creates their
+// zero-price order, takes the item out of stock and closes the rest of
+// the queue. It reports false if the item was already gone.
+func acceptFreeItemRequest(tx *sql.Tx, requestID string) (bool, error) {
+	var itemID, requesterID, addressID, sellerID, title string
+	var available bool
+	err := tx.QueryRow(`
+		SELECT fr.item_id, fr.requester_id, fr.address_id, i.seller_id, i.title,
+			   i.status = 'available' AND i.quantity > 0 AND i.deleted_at IS NULL
+		FROM free_item_requests fr
+		JOIN items i ON fr.item_id = i.id
+		WHERE fr.id = $1
+		FOR UPDATE OF i`,
+		requestID).Scan(&itemID, &requesterID, &addressID, &sellerID, &title, &available)
+	if err != nil || !available {
+		return false, err
+	}
+
+	var orderID string
+	err = tx.QueryRow(`
+		INSERT INTO orders (user_id, address_id, total, status)
+		VALUES ($1, $2, 0, 'pending')
+		RETURNING id`,
+		requesterID, addressID).Scan(&orderID)
+	if err != nil {
+		return false, err
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO order_items (order_id, item_id, price_at_time)
+		VALUES ($1, $2, 0)`,
+		orderID, itemID)
+	if err != nil {
+		return false, err
+	}
+
+	_, err = tx.Exec(`
+		UPDATE items
+		SET quantity = quantity - 1,
+			status = CASE
+					WHEN quantity - 1 <= 0 THEN 'sold'::item_status_enum
+					ELSE status
+			END
+		WHERE id = $1`,
+		itemID)
+	if err != nil {
+		return false, err
+	}
+
+	if err := sellBundleStock(tx, orderID); err != nil {
+		return false, err
+	}
+
+	_, err = tx.Exec(`
+		UPDATE free_item_requests
+		SET status = 'accepted', order_id = $1, decided_at = CURRENT_TIMESTAMP
+		WHERE id = $2`,
+		orderID, requestID)
+	if err != nil {
+		return false, err
+	}
+
+	err = createNotification(tx, requesterID, "free_request", requestID,
+		fmt.Sprintf("Good news: %s is yours. Follow up through order #%s", title, orderID))
+	if err != nil {
+		return false, err
+	}
+
+	err = createNotification(tx, sellerID, "order_status", orderID,
+		fmt.Sprintf("New order #%s for your free item %s", orderID, title))
+	if err != nil {
+		return false, err
+	}
+
+	// Close the queue once the last one is given away
+	_, err = tx.Exec(`
+		WITH closed AS (
+			UPDATE free_item_requests fr
+			SET status = 'declined', decided_at = CURRENT_TIMESTAMP
+			FROM items i
+			WHERE i.id = fr.item_id AND fr.item_id = $1
+			AND fr.status = 'pending' AND i.quantity <= 0
+			RETURNING fr.id, fr.requester_id
+		)
+		INSERT INTO notifications (user_id, type, reference_id, message, read)
+		SELECT requester_id, 'free_request', id, $2, false FROM closed`,
+		itemID, fmt.Sprintf("%s has been given to someone else", title))
+	return true, err
+}
@@ -24,6 +24,150 @@ const ItemDetailModal = ({ item, onClose, currentUser, token, setShowLogin }) =>
    }
  };
 
+ const addToFavorites = async (itemId) => {
+   if (!token) {
+     setShowLogin(true);
+     return;
+   }
+
+   try {
+     const response = await fetch('http://localhost:8080/user/favorites', {
+       method: 'POST',
+       headers: {
+         'Content-Type': 'application/json',
+         'Authorization': `Bearer ${token}`
+       },
+       body: JSON.stringify({ item_id: itemId })
+     });
+
+     if (!response.ok) {
+       const error = await response.text();
+       alert(error);
+       return;
+     }
+
+     alert('Saved to favorites - we will let you know if the price drops');
+   } catch (error) {
+     console.error('Error saving favorite:', error);
+   }
+ };
+
+ const makeOffer = async (itemId) => {
+   if (!token) {
+     setShowLogin(true);
+     return;
+   }
+
+   const amount = parseFloat(window.prompt(`Your offer (listed at $${item.price.toFixed(2)}):`));
+   if (!amount) return;
+
+   try {
+     const response = await fetch('http://localhost:8080/offers', {
+       method: 'POST',
+       headers: {
+         'Content-Type': 'application/json',
+         'Authorization': `Bearer ${token}`
+       },
+       body: JSON.stringify({ item_id: itemId, amount })
+     });
+
+     if (!response.ok) {
+       const error = await response.text();
+       alert(error);
+       return;
+     }
+
+     alert('Offer sent - the seller has 48 hours to respond');
+   } catch (error) {
+     console.error('Error making offer:', error);
+   }
+ };
+
+ const requestFreeItem = async (itemId) => {
+   if (!token) {
+     setShowLogin(true);
+     return;
+   }
+
+   try {
+     const addressResponse = await fetch('http://localhost:8080/user/addresses', {
+       headers: { 'Authorization': `Bearer ${token}` }
+     });
+     const addresses = await addressResponse.json();
+     if (!addresses || addresses.length === 0) {
+       alert('Add a shipping address in your dashboard first');
+       return;
+     }
+
+     const note = window.prompt('Add a note for the giver (optional):') || '';
+     const response = await fetch(`http://localhost:8080/items/${itemId}/requests`, {
+       method: 'POST',
+       headers: {
+         'Content-Type': 'application/json',
+         'Authorization': `Bearer ${token}`
+       },
+       body: JSON.stringify({ address_id: addresses[0].id, message: note })
+     });
+
+     if (!response.ok) {
+       const error = await response.text();
+       alert(error);
+       return;
+     }
+
+     const request = await response.json();
+     alert(request.status === 'accepted'
+       ? 'The item is yours - check your orders'
+       : 'Request sent - the giver will pick a recipient');
+   } catch (error) {
+     console.error('Error requesting item:', error);
+   }
+ };
+
+ const placeBid = async () => {
+   if (!token) {
+     setShowLogin(true);
+     return;
+   }
+
+   try {
+     const auctionResponse = await fetch(`http://localhost:8080/auctions?id=${item.auction_id}`);
+     const auction = await auctionResponse.json();
+     const amount = parseFloat(window.prompt(
+       `Your bid (at least $${auction.minimum_bid.toFixed(2)}, ends ${new Date(auction.ends_at).toLocaleString()}):`
+     ));
+     if (!amount) return;
+
+     const addressResponse = await fetch('http://localhost:8080/user/addresses', {
+       headers: { 'Authorization': `Bearer ${token}` }
+     });
+     const addresses = await addressResponse.json();
+     if (!addresses || addresses.length === 0) {
+       alert('Add a shipping address in your dashboard first');
+       return;
+     }
+
+     const response = await fetch(`http://localhost:8080/auctions/bid?id=${item.auction_id}`, {
+       method: 'POST',
+       headers: {
+         'Content-Type': 'application/json',
+         'Authorization': `Bearer ${token}`
+       },
+       body: JSON.stringify({ amount, address_id: addresses[0].id })
+     });
+
+     if (!response.ok) {
+       const error = await response.text();
+       alert(error);
+       return;
+     }
+
+     alert('Bid placed - we will let you know if you are outbid');
+   } catch (error) {
+     console.error('Error placing bid:', error);
+   }
+ };
+
  const addToCart = async (itemId) => {
    if (!token) {
      setShowLogin(true);
@@ -65,7 +209,7 @@ const ItemDetailModal = ({ item, onClose, currentUser, token, setShowLogin }) =>
          <div>
            {item.images?.[0] && (
              <img
-               src={`http://localhost:8080/images?path=${item.images[0]}`}
+               src={`http://localhost:8080/items/${item.id}/images/0`}
                alt={item.title}
                className="w-full h-64 object-cover rounded"
              />
@@ -73,15 +217,36 @@ const ItemDetailModal = ({ item, onClose, currentUser, token, setShowLogin }) =>
          </div>
 
          <div>
-           <p className="text-xl font-bold mb-2">${item.price.toFixed(2)}</p>
+           <p className="text-xl font-bold mb-2">{item.free ? 'Free' : `$${item.price.toFixed(2)}`}</p>
            <p className="mb-2 text-gray-600">Seller: {item.seller_name}</p>
+           {item.favorites_count > 0 && (
+             <p className="mb-2 text-sm text-gray-500">{item.favorites_count} people saved this</p>
+           )}
            <p className="text-gray-600 mb-4">{item.description}</p>
            <div className="flex gap-2 mb-4">
              <span className="bg-gray-200 px-2 py-1 rounded">{item.size}</span>
              <span className="bg-gray-200 px-2 py-1 rounded">{item.category}</span>
            </div>
 
-           {currentUser?.id !== item.seller_id && item.quantity > 0 && (
+           {currentUser?.id !== item.seller_id && item.quantity > 0 && item.free && (
+             <button
+               onClick={() => requestFreeItem(item.id)}
+               className="w-full bg-green-500 text-white px-4 py-2 rounded hover:bg-green-600 mb-4"
+             >
+               Request This Item
+             </button>
+           )}
+
+           {currentUser?.id !== item.seller_id && item.quantity > 0 && item.auction_id && (
+             <button
+               onClick={placeBid}
+               className="w-full bg-purple-500 text-white px-4 py-2 rounded hover:bg-purple-600 mb-4"
+             >
+               Place a Bid
+             </button>
+           )}
+
+           {currentUser?.id !== item.seller_id && item.quantity > 0 && !item.free && !item.auction_id && (
              <button
                onClick={() => addToCart(item.id)}
                className="w-full bg-blue-500 text-white px-4 py-2 rounded hover:bg-blue-600 mb-4"
@@ -90,6 +255,24 @@ const ItemDetailModal = ({ item, onClose, currentUser, token, setShowLogin }) =>
              </button>
            )}
 
+           {currentUser?.id !== item.seller_id && item.quantity > 0 && !item.free && !item.auction_id && (
+             <button
+               onClick={() => makeOffer(item.id)}
+               className="w-full border border-blue-500 text-blue-500 px-4 py-2 rounded hover:bg-blue-50 mb-4"
+             >
+               Make an Offer
+             </button>
+           )}
+
+           {currentUser?.id !== item.seller_id && (
+             <button
+               onClick={() => addToFavorites(item.id)}
+               className="w-full border border-blue-500 text-blue-500 px-4 py-2 rounded hover:bg-blue-50 mb-4"
+             >
+               Save to Favorites
+             </button>
+           )}
+
            {currentUser?.id !== item.seller_id && (
              <div className="mt-4">
                <h3 className="font-bold mb-2">Ask Seller a Question</h3>
@@ -127,6 +310,9 @@ ItemDetailModal.propTypes = {
    seller_id: PropTypes.string.isRequired,
    seller_name: PropTypes.string.isRequired,
    quantity: PropTypes.number.isRequired,
+   favorites_count: PropTypes.number,
+   free: PropTypes.bool,
+   auction_id: PropTypes.string,
    images: PropTypes.arrayOf(PropTypes.string)
  }).isRequired,
  onClose: PropTypes.func.isRequired,
@@ -1,10 +1,19 @@
-import { useState, useEffect } from 'react';
+import { useState, useEffect, useRef } from 'react';
 import NotificationSystem from '../components/NotificationSystem';
 import ItemDetailModal from '../components/ItemDetailModal';
 
 export default function Marketplace() {
   // Core state
   const [items, setItems] = useState([]);
+  const [nextCursor, setNextCursor] = useState(null);
+  const [loadingItems, setLoadingItems] = useState(false);
+  const [facets, setFacets] = useState(null);
+  const [didYouMean, setDidYouMean] = useState('');
+  const [suggestions, setSuggestions] = useState([]);
+  const loadMoreRef = useRef(null);
+  // Bumped whenever the filters change, so pages of an older search that
+  // arrive late are dropped instead of mixed into the new results
+  const searchIdRef = useRef(0);
   const [cartItems, setCartItems] = useState([]);
   const [searchQuery, setSearchQuery] = useState('');
   const [category, setCategory] = useState('');
@@ -42,6 +51,17 @@ export default function Marketplace() {
   const categories = ['tops', 'bottoms', 'outerwear', 'footwear', 'accessories'];
   const sizes = ['XS', 'S', 'M', 'L', 'XL'];
 
+  // Options with their result counts once the search has returned facets;
+  // the selected option stays listed even if nothing matches it
+  const facetOptions = (name, values, selected) => {
+    if (!facets?.[name]) return values.map(value => ({ value, label: value }));
+    const options = facets[name].map(f => ({ value: f.value, label: `${f.value} (${f.count})` }));
+    if (selected && !options.some(o => o.value === selected)) {
+      options.push({ value: selected, label: `${selected} (0)` });
+    }
+    return options;
+  };
+
   // Auth handlers
   const signup = async (e) => {
     e.preventDefault();
@@ -179,6 +199,24 @@ export default function Marketplace() {
     }
   };
 
+  const acceptCartPrice = async (itemId) => {
+    try {
+      const response = await fetch('http://localhost:8080/cart/accept-price', {
+        method: 'POST',
+        headers: {
+          'Content-Type': 'application/json',
+          'Authorization': `Bearer ${token}`
+        },
+        body: JSON.stringify({ item_id: itemId })
+      });
+
+      if (!response.ok) throw new Error('Failed to accept price');
+      fetchCart();
+    } catch (error) {
+      console.error('Error accepting price:', error);
+    }
+  };
+
   // Checkout handlers
   const fetchSavedAddresses = async () => {
     if (!token) return;
@@ -236,7 +274,8 @@ export default function Marketplace() {
   };
 
   // Item handlers
-  const fetchItems = async () => {
+  // Fetches the first page, or the page after cursor when scrolling
+  const fetchItems = async (cursor = null) => {
     const params = new URLSearchParams({
       q: searchQuery,
       category,
@@ -244,42 +283,73 @@ export default function Marketplace() {
       min_price: priceRange.min,
       max_price: priceRange.max
     });
+    if (sortBy) params.set('sort', sortBy);
+    if (cursor) params.set('cursor', cursor);
+    else params.set('facets', 'true');
 
+    if (!cursor) searchIdRef.current += 1;
+    const searchId = searchIdRef.current;
+    const isCurrent = () => searchId === searchIdRef.current;
+
+    setLoadingItems(true);
     try {
       const response = await fetch(`http://localhost:8080/items/search?${params}`);
       const data = await response.json();
-
-      if (sortBy && data?.length) {
-        setItems(sortItems(data, sortBy));
-      } else {
-        setItems(data || []);
+      if (!isCurrent()) return;
+      const pageItems = data?.items || [];
+
+      setItems(prev => cursor ? [...prev, ...pageItems] : pageItems);
+      setNextCursor(data?.next_cursor || null);
+      if (!cursor) {
+        setFacets(data?.facets || null);
+        setDidYouMean(data?.did_you_mean || '');
       }
     } catch (error) {
+      if (!isCurrent()) return;
       console.error('Error fetching items:', error);
-      setItems([]);
+      if (!cursor) setItems([]);
+      setNextCursor(null);
+    } finally {
+      if (isCurrent()) setLoadingItems(false);
     }
   };
 
-  const sortItems = (items, sortType) => {
-    return [...items].sort((a, b) => {
-      switch (sortType) {
-        case 'price-asc':
-          return a.price - b.price;
-        case 'price-desc':
-          return b.price - a.price;
-        case 'newest':
-          return new Date(b.created_at) - new Date(a.created_at);
-        default:
-          return 0;
-      }
-    });
-  };
-
   // Effects
   useEffect(() => {
     fetchItems();
   }, [searchQuery, category, size, sortBy, priceRange]);
 
+  // Search-as-you-type completions
+  useEffect(() => {
+    if (!searchQuery.trim()) {
+      setSuggestions([]);
+      return;
+    }
+    const timer = setTimeout(async () => {
+      try {
+        const response = await fetch(`http://localhost:8080/items/suggest?q=${encodeURIComponent(searchQuery)}`);
+        setSuggestions(await response.json() || []);
+      } catch (error) {
+        console.error('Error fetching suggestions:', error);
+      }
+    }, 150);
+    return () => clearTimeout(timer);
+  }, [searchQuery]);
+
+  // Infinite scroll: load the next page when the end of the grid is visible
+  useEffect(() => {
+    const sentinel = loadMoreRef.current;
+    if (!sentinel || !nextCursor) return;
+
+    const observer = new IntersectionObserver(entries => {
+      if (entries[0].isIntersecting && !loadingItems) {
+        fetchItems(nextCursor);
+      }
+    });
+    observer.observe(sentinel);
+    return () => observer.disconnect();
+  }, [nextCursor, loadingItems]);
+
   useEffect(() => {
     if (token) {
       fetchCart();
@@ -359,7 +429,13 @@ export default function Marketplace() {
             className="border p-2 rounded"
             value={searchQuery}
             onChange={(e) => setSearchQuery(e.target.value)}
+            list="search-suggestions"
           />
+          <datalist id="search-suggestions">
+            {suggestions.map(s => (
+              <option key={`${s.type}:${s.text}`} value={s.text} />
+            ))}
+          </datalist>
 
           <select
             className="border p-2 rounded"
@@ -367,8 +443,8 @@ export default function Marketplace() {
             onChange={(e) => setCategory(e.target.value)}
           >
             <option value="">All Categories</option>
-            {categories.map(cat => (
-              <option key={cat} value={cat}>{cat}</option>
+            {facetOptions('category', categories, category).map(opt => (
+              <option key={opt.value} value={opt.value}>{opt.label}</option>
             ))}
           </select>
 
@@ -378,8 +454,8 @@ export default function Marketplace() {
             onChange={(e) => setSize(e.target.value)}
           >
             <option value="">All Sizes</option>
-            {sizes.map(s => (
-              <option key={s} value={s}>{s}</option>
+            {facetOptions('size', sizes, size).map(opt => (
+              <option key={opt.value} value={opt.value}>{opt.label}</option>
             ))}
           </select>
 
@@ -389,9 +465,11 @@ export default function Marketplace() {
             onChange={(e) => setSortBy(e.target.value)}
           >
             <option value="">Sort By</option>
-            <option value="price-asc">Price: Low to High</option>
-            <option value="price-desc">Price: High to Low</option>
+            <option value="relevance">Best Match</option>
+            <option value="price_asc">Price: Low to High</option>
+            <option value="price_desc">Price: High to Low</option>
             <option value="newest">Newest First</option>
+            <option value="reduced">Recently Reduced</option>
           </select>
         </div>
 
@@ -414,6 +492,16 @@ export default function Marketplace() {
         </div>
       </div>
 
+      {didYouMean && (
+        <p className="mb-4 text-gray-700">
+          Did you mean{' '}
+          <button className="text-blue-600 underline" onClick={() => setSearchQuery(didYouMean)}>
+            {didYouMean}
+          </button>
+          ?
+        </p>
+      )}
+
       {/* Items grid */}
 <div className="grid grid-cols-1 md:grid-cols-2 lg:grid-cols-3 gap-6">
   {items.map(item => (
@@ -424,7 +512,7 @@ export default function Marketplace() {
     >
       {item.images && item.images.length > 0 && (
         <img
-          src={`http://localhost:8080/images?path=${item.images[0]}`}
+          src={`http://localhost:8080/items/${item.id}/images/0?size=medium`}
           alt={item.title}
           className="w-full h-64 object-cover"
         />
@@ -467,6 +555,8 @@ export default function Marketplace() {
     </div>
   ))}
 </div>
+<div ref={loadMoreRef} className="h-8" />
+{loadingItems && <p className="text-center text-gray-500 my-4">Loading...</p>}
 
 {/* Item Detail Modal */}
 {selectedItem && (
@@ -615,6 +705,23 @@ export default function Marketplace() {
                     <div>
                       <h3 className="font-bold">{item.title}</h3>
                       <p className="text-gray-600">${item.price}</p>
+                      {item.discount_percent > 0 && (
+                        <p className="text-sm text-green-600">Includes {item.discount_percent}% multi-buy discount</p>
+                      )}
+                      {item.cart_status === 'removed' && (
+                        <p className="text-sm text-red-600">No longer listed by the seller</p>
+                      )}
+                      {item.cart_status === 'sold' && (
+                        <p className="text-sm text-red-600">Sold out</p>
+                      )}
+                      {item.cart_status === 'price_changed' && (
+                        <p className="text-sm text-orange-600">
+                          Price changed since you added it (was ${item.price_at_add})
+                          <button onClick={() => acceptCartPrice(item.id)} className="ml-2 underline">
+                            OK
+                          </button>
+                        </p>
+                      )}
                     </div>
                     <button
                       onClick={() => removeFromCart(item.id)}
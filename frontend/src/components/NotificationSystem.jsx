@@ -2,6 +2,21 @@ import React, { useState, useEffect } from 'react';
 import { Bell } from 'lucide-react';
 import { useNavigate } from 'react-router-dom';
 
+const notificationTitles = {
+  order_status: 'Order Status Update',
+  saved_search: 'New Match for a Saved Search',
+  saved_search_digest: 'Saved Search Digest',
+  price_drop: 'Price Drop on a Favorite',
+  back_in_stock: 'Favorite Back in Stock',
+  offer: 'Offer Update',
+  trade: 'Swap Proposal',
+  free_request: 'Free Item Request',
+  auction: 'Auction Update'
+};
+
+// Notification types that refer to an order rather than a listing
+const orderNotificationTypes = ['message', 'order_status'];
+
 const NotificationSystem = () => {
   const [notifications, setNotifications] = useState([]);
   const [showNotifications, setShowNotifications] = useState(false);
@@ -68,7 +83,7 @@ const NotificationSystem = () => {
       const notificationsResponse = await fetch('http://localhost:8080/notifications/unread', {
         headers: { 'Authorization': `Bearer ${token}` }
       });
-      const orderNotifications = await notificationsResponse.json();
+      const orderNotifications = (await notificationsResponse.json())?.items;
 
       const messageNotifications = unreadMessages?.map(msg => ({
         id: msg.id,
@@ -84,7 +99,7 @@ const NotificationSystem = () => {
         id: note.id,
         type: note.type,
         orderId: note.reference_id,
-        title: note.type === 'order_status' ? 'Order Status Update' : 'New Order',
+        title: notificationTitles[note.type] || 'New Order',
         message: note.message,
         timestamp: note.created_at
       })) || [];
@@ -111,7 +126,11 @@ const NotificationSystem = () => {
     }
 
     setNotifications(prev => prev.filter(n => n.id !== notification.id));
-    navigate('/dashboard', { state: { openOrder: notification.orderId, scrollToMessages: true }});
+    if (orderNotificationTypes.includes(notification.type)) {
+      navigate('/dashboard', { state: { openOrder: notification.orderId, scrollToMessages: true }});
+    } else {
+      navigate('/');
+    }
     setShowNotifications(false);
   };
 
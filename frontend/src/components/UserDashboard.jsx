@@ -15,6 +15,24 @@ const getUserIdFromToken = (token) => {
   }
 };
 
+// Fetches every page of a paginated list by following next_cursor
+const fetchAllPages = async (url, token) => {
+  const all = [];
+  let cursor = null;
+  do {
+    const params = new URLSearchParams({ limit: '100' });
+    if (cursor) params.set('cursor', cursor);
+    const response = await fetch(`${url}?${params}`, {
+      headers: { 'Authorization': `Bearer ${token}` }
+    });
+    if (!response.ok) throw new Error(await response.text());
+    const data = await response.json();
+    all.push(...(data?.items || []));
+    cursor = data?.next_cursor || null;
+  } while (cursor);
+  return all;
+};
+
 export default function UserDashboard() {
   const [activeTab, setActiveTab] = useState('purchased');
   const [userItems, setUserItems] = useState([]);
@@ -115,11 +133,7 @@ export default function UserDashboard() {
 
   const fetchUserItems = async () => {
     try {
-      const response = await fetch('http://localhost:8080/user/items', {
-        headers: { 'Authorization': `Bearer ${token}` }
-      });
-      const data = await response.json();
-      setUserItems(data || []);
+      setUserItems(await fetchAllPages('http://localhost:8080/user/items', token));
     } catch (error) {
       console.error('Error fetching items:', error);
     }
@@ -127,11 +141,7 @@ export default function UserDashboard() {
 
   const fetchOrders = async () => {
     try {
-      const response = await fetch('http://localhost:8080/user/orders', {
-        headers: { 'Authorization': `Bearer ${token}` }
-      });
-      const data = await response.json();
-      setOrders(data || []);
+      setOrders(await fetchAllPages('http://localhost:8080/user/orders', token));
     } catch (error) {
       console.error('Error fetching orders:', error);
     }
@@ -139,13 +149,10 @@ export default function UserDashboard() {
 
   const fetchMessages = async (orderId) => {
     try {
-      const response = await fetch(`http://localhost:8080/orders/${orderId}/messages`, {
-        headers: { 'Authorization': `Bearer ${token}` }
-      });
-      const data = await response.json();
-      setMessages(data || []);
+      const orderMessages = await fetchAllPages(`http://localhost:8080/orders/${orderId}/messages`, token);
+      setMessages(orderMessages);
 
-      const uniqueUserIds = [...new Set(data.map(msg => msg.sender_id))];
+      const uniqueUserIds = [...new Set(orderMessages.map(msg => msg.sender_id))];
       uniqueUserIds.forEach(fetchUserName);
     } catch (error) {
       console.error('Error fetching messages:', error);
@@ -519,7 +526,7 @@ export default function UserDashboard() {
               }`}>
                 {item.images?.[0] && (
                   <img
-                    src={`http://localhost:8080/images?path=${item.images[0]}`}
+                    src={`http://localhost:8080/items/${item.id}/images/0?size=medium`}
                     alt={item.title}
                     className="w-full h-48 object-cover"
                   />
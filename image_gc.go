@@ -0,0 +1,163 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"time"
+)
+
+// ImageGCReport lists where the blob store and item_images disagree
+type ImageGCReport struct {
+	OrphanedBlobs []BlobInfo // stored files no item_images row refers to
+	MissingBlobs  []string   // item_images rows whose file is gone
+	CheckedRows   int        // item_images rows compared with the store
+}
+
+type imageRow struct {
+	id        string
+	path      string
+	createdAt time.Time
+}
+
+// reconcileImages compares the stored uploads with the item_images table.
+// Anything newer than grace is left out of the report since it may belong
+// to an upload whose transaction has not committed yet.
+func reconcileImages(grace time.Duration) (*ImageGCReport, []imageRow, error) {
+	cutoff := time.Now().Add(-grace)
+
+	rows, err := db.Query(`SELECT id, image_path, created_at FROM item_images`)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var imageRows []imageRow
+	known := make(map[string]bool)
+	for rows.Next() {
+		var row imageRow
+		if err := rows.Scan(&row.id, &row.path, &row.createdAt); err != nil {
+			rows.Close()
+			return nil, nil, err
+		}
+		imageRows = append(imageRows, row)
+		for _, key := range imageFilePaths(row.path) {
+			known[key] = true
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	stored, err := blobs.List("uploads/")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	present := make(map[string]bool, len(stored))
+	report := &ImageGCReport{CheckedRows: len(imageRows)}
+	for _, blob := range stored {
+		present[blob.Key] = true
+		if !known[blob.Key] && blob.ModTime.Before(cutoff) {
+			report.OrphanedBlobs = append(report.OrphanedBlobs, blob)
+		}
+	}
+
+	var missingRows []imageRow
+	for _, row := range imageRows {
+		if !present[row.path] && row.createdAt.Before(cutoff) {
+			report.MissingBlobs = append(report.MissingBlobs, row.path)
+			missingRows = append(missingRows, row)
+		}
+	}
+
+	return report, missingRows, nil
+}
+
+// startImageReconciler periodically logs drift between the blob store and
+// item_images. Cleanup is left to the gc-images command.
+func startImageReconciler(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		report, _, err := reconcileImages(24 * time.Hour)
+		if err != nil {
+			log.Printf("Error reconciling images: %v", err)
+			continue
+		}
+		if len(report.OrphanedBlobs) > 0 || len(report.MissingBlobs) > 0 {
+			log.Printf("Image reconciliation: %d orphaned files, %d image rows without files (run gc-images to clean up)",
+				len(report.OrphanedBlobs), len(report.MissingBlobs))
+		}
+	}
+}
+
+// runImageGC reports drift between the blob store and item_images. With
+// -delete it removes orphaned files, and with -delete-rows the rows whose
+// file is missing. Nothing is deleted when more than -max-missing of the
+// rows lack a file, which rather means the wrong store is configured.
+//
+//	go run . gc-images [-grace 24h] [-delete] [-delete-rows] [-max-missing 0.05]
+func runImageGC(args []string) {
+	fs := flag.NewFlagSet("gc-images", flag.ExitOnError)
+	grace := fs.Duration("grace", 24*time.Hour, "ignore files and rows younger than this")
+	deleteOrphans := fs.Bool("delete", false, "delete orphaned files")
+	deleteRows := fs.Bool("delete-rows", false, "delete image rows whose file is missing")
+	maxMissing := fs.Float64("max-missing", 0.05, "refuse to delete anything when a larger share of image rows has no file")
+	fs.Parse(args)
+
+	report, missingRows, err := reconcileImages(*grace)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	for _, blob := range report.OrphanedBlobs {
+		log.Printf("Orphaned file: %s (%d bytes, modified %s)", blob.Key, blob.Size, blob.ModTime.Format(time.RFC3339))
+	}
+	for _, path := range report.MissingBlobs {
+		log.Printf("Missing file for image row: %s", path)
+	}
+	log.Printf("Found %d orphaned files and %d image rows without files",
+		len(report.OrphanedBlobs), len(report.MissingBlobs))
+
+	if !*deleteOrphans && !*deleteRows {
+		return
+	}
+
+	if report.CheckedRows > 0 {
+		share := float64(len(report.MissingBlobs)) / float64(report.CheckedRows)
+		if share > *maxMissing {
+			log.Fatalf("Refusing to clean up: %.1f%% of image rows have no file, check the blob store configuration",
+				share*100)
+		}
+	}
+
+	var failed int
+	if *deleteOrphans {
+		for _, blob := range report.OrphanedBlobs {
+			if err := blobs.Delete(blob.Key); err != nil {
+				log.Printf("Error deleting %s: %v", blob.Key, err)
+				failed++
+			}
+		}
+	}
+
+	if *deleteRows {
+		for _, row := range missingRows {
+			// Thumbnails may survive the original; remove them with the row
+			for variant := range imageVariants {
+				blobs.Delete(imageVariantPath(row.path, variant))
+			}
+			if _, err := db.Exec(`DELETE FROM item_images WHERE id = $1`, row.id); err != nil {
+				log.Printf("Error deleting image row %s: %v", row.id, err)
+				failed++
+			}
+		}
+	}
+
+	log.Printf("Cleanup finished with %d errors", failed)
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
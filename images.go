@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	_ "image/png"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+const (
+	maxImageDimension = 1600     // longest edge of the stored full-size image
+	maxImagePixels    = 50000000 // refuse to decode anything larger
+	jpegQuality       = 85
+)
+
+// Thumbnail variants stored next to every upload, keyed by the name used in
+// the size query parameter and giving the longest edge in pixels.
+var imageVariants = map[string]int{
+	"small":  200,
+	"medium": 600,
+}
+
+var allowedImageTypes = map[string]bool{
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/webp": true,
+}
+
+// errInvalidImage is returned for uploads that are not an acceptable image.
+// Handlers report it as a client error.
+var errInvalidImage = errors.New("invalid image")
+
+// decodeUpload validates an uploaded image by its content rather than its
+// file name, decodes it and applies the EXIF orientation so the picture
+// displays the right way up once the metadata has been discarded.
+func decodeUpload(src io.Reader) (image.Image, error) {
+	data, err := io.ReadAll(io.LimitReader(src, maxFileSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxFileSize {
+		return nil, fmt.Errorf("%w: file exceeds %dMB", errInvalidImage, maxFileSize>>20)
+	}
+
+	contentType := http.DetectContentType(data)
+	if !allowedImageTypes[contentType] {
+		return nil, fmt.Errorf("%w: only JPEG, PNG and WebP images are allowed", errInvalidImage)
+	}
+
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidImage, err)
+	}
+	if cfg.Width*cfg.Height > maxImagePixels {
+		return nil, fmt.Errorf("%w: image dimensions too large", errInvalidImage)
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidImage, err)
+	}
+
+	if contentType == "image/jpeg" {
+		img = applyOrientation(img, jpegOrientation(data))
+	}
+	return img, nil
+}
+
+// resizeToFit scales img down so its longest edge is at most maxEdge and
+// flattens any transparency onto white, ready for JPEG encoding.
+func resizeToFit(img image.Image, maxEdge int) image.Image {
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	if w > maxEdge || h > maxEdge {
+		if w >= h {
+			h = h * maxEdge / w
+			w = maxEdge
+		} else {
+			w = w * maxEdge / h
+			h = maxEdge
+		}
+	}
+	if w < 1 {
+		w = 1
+	}
+	if h < 1 {
+		h = 1
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(dst, dst.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, bounds, draw.Over, nil)
+	return dst
+}
+
+func storeJPEG(key string, img image.Image) error {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: jpegQuality}); err != nil {
+		return err
+	}
+	return blobs.Put(key, &buf, "image/jpeg")
+}
+
+// imageVariantPath returns the stored path of a thumbnail variant for the
+// image at imagePath, e.g. uploads/abc.jpg -> uploads/abc_small.jpg.
+func imageVariantPath(imagePath, variant string) string {
+	ext := filepath.Ext(imagePath)
+	return strings.TrimSuffix(imagePath, ext) + "_" + variant + ext
+}
+
+// imageFilePaths lists the stored image and all of its variants
+func imageFilePaths(imagePath string) []string {
+	paths := []string{imagePath}
+	for variant := range imageVariants {
+		paths = append(paths, imageVariantPath(imagePath, variant))
+	}
+	return paths
+}
+
+// removeImageFiles deletes an image and its thumbnails. Missing files are
+// ignored since images uploaded before thumbnails existed have none.
+func removeImageFiles(imagePath string) error {
+	var firstErr error
+	for _, path := range imageFilePaths(imagePath) {
+		if err := blobs.Delete(path); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// copyBlob copies a stored blob to a new key in the same store. The content
+// type is taken from the data since uploads from before images were
+// re-encoded may be PNG or WebP.
+func copyBlob(srcKey, dstKey string) error {
+	src, err := blobs.Open(srcKey)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	contentType, content, err := sniffContentType(src)
+	if err != nil {
+		return err
+	}
+	return blobs.Put(dstKey, content, contentType)
+}
+
+// jpegOrientation returns the EXIF orientation tag of a JPEG, or 1 (normal)
+// if there is none.
+func jpegOrientation(data []byte) int {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return 1
+	}
+
+	pos := 2
+	for pos+4 <= len(data) {
+		if data[pos] != 0xFF {
+			return 1
+		}
+		marker := data[pos+1]
+		segmentLen := int(binary.BigEndian.Uint16(data[pos+2:]))
+		if marker == 0xDA || segmentLen < 2 || pos+2+segmentLen > len(data) {
+			// Start of scan: metadata segments are all before this
+			return 1
+		}
+
+		segment := data[pos+4 : pos+2+segmentLen]
+		if marker == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return exifOrientation(segment[6:])
+		}
+		pos += 2 + segmentLen
+	}
+	return 1
+}
+
+func exifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd+2 > len(tiff) {
+		return 1
+	}
+
+	entries := int(order.Uint16(tiff[ifd:]))
+	for i := 0; i < entries; i++ {
+		entry := ifd + 2 + i*12
+		if entry+12 > len(tiff) {
+			return 1
+		}
+		if order.Uint16(tiff[entry:]) == 0x0112 {
+			orientation := int(order.Uint16(tiff[entry+8:]))
+			if orientation < 1 || orientation > 8 {
+				return 1
+			}
+			return orientation
+		}
+	}
+	return 1
+}
+
+// applyOrientation rotates and flips img according to an EXIF orientation
+func applyOrientation(img image.Image, orientation int) image.Image {
+	if orientation <= 1 || orientation > 8 {
+		return img
+	}
+
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+
+	dstW, dstH := w, h
+	if orientation >= 5 {
+		dstW, dstH = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dstW, dstH))
+
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2:
+				dx, dy = w-1-x, y
+			case 3:
+				dx, dy = w-1-x, h-1-y
+			case 4:
+				dx, dy = x, h-1-y
+			case 5:
+				dx, dy = y, x
+			case 6:
+				dx, dy = h-1-y, x
+			case 7:
+				dx, dy = h-1-y, w-1-x
+			case 8:
+				dx, dy = y, w-1-x
+			}
+			dst.Set(dx, dy, img.At(bounds.Min.X+x, bounds.Min.Y+y))
+		}
+	}
+	return dst
+}
+
+// sniffContentType reports the content type of stored image data and
+// returns a reader that still yields the complete content.
+func sniffContentType(r io.Reader) (string, io.Reader, error) {
+	buf := make([]byte, 512)
+	n, err := io.ReadFull(r, buf)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", nil, err
+	}
+	return http.DetectContentType(buf[:n]), io.MultiReader(bytes.NewReader(buf[:n]), r), nil
+}
@@ -0,0 +1,550 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	maxImportSize = 200 << 20 // 200MB including the image archive
+	maxImportRows = 1000
+)
+
+// ItemRecord is the portable representation of a listing used by bulk
+// import and export. Images are referenced by file name within the image
+// archive.
+type ItemRecord struct {
+	Title       string     `json:"title"`
+	Description string     `json:"description"`
+	Brand       string     `json:"brand,omitempty"`
+	Price       float64    `json:"price"`
+	Size        string     `json:"size"`
+	Category    string     `json:"category"`
+	Condition   string     `json:"condition,omitempty"`
+	LocalPickup bool       `json:"local_pickup,omitempty"`
+	Status      string     `json:"status,omitempty"`
+	PublishAt   *time.Time `json:"publish_at,omitempty"`
+	Images      []string   `json:"images"`
+}
+
+type ImportRowResult struct {
+	Row    int      `json:"row"`
+	ItemID string   `json:"item_id,omitempty"`
+	Errors []string `json:"errors,omitempty"`
+}
+
+var itemRecordColumns = []string{
+	"title", "description", "brand", "price", "size", "category", "condition", "local_pickup", "status", "publish_at", "images",
+}
+
+// parseItemRecordsCSV reads listings from a CSV file with a header row.
+// Columns may appear in any order; images are separated by semicolons.
+// Rows that cannot be parsed are reported in rowErrs keyed by row number.
+func parseItemRecordsCSV(r io.Reader) ([]ItemRecord, map[int][]string, error) {
+	reader := csv.NewReader(r)
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, nil, fmt.Errorf("reading CSV header: %v", err)
+	}
+
+	columns := make(map[string]int)
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	for _, required := range []string{"title", "price", "size", "category"} {
+		if _, ok := columns[required]; !ok {
+			return nil, nil, fmt.Errorf("CSV is missing required column %q", required)
+		}
+	}
+
+	field := func(row []string, name string) string {
+		if i, ok := columns[name]; ok && i < len(row) {
+			return strings.TrimSpace(row[i])
+		}
+		return ""
+	}
+
+	var records []ItemRecord
+	rowErrs := make(map[int][]string)
+	for {
+		row, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("reading CSV: %v", err)
+		}
+
+		rowNum := len(records) + 1
+		record := ItemRecord{
+			Title:       field(row, "title"),
+			Description: field(row, "description"),
+			Brand:       field(row, "brand"),
+			Size:        field(row, "size"),
+			Category:    field(row, "category"),
+			Condition:   field(row, "condition"),
+			Status:      field(row, "status"),
+		}
+
+		if price := field(row, "price"); price != "" {
+			record.Price, err = strconv.ParseFloat(price, 64)
+			if err != nil {
+				rowErrs[rowNum] = append(rowErrs[rowNum], fmt.Sprintf("invalid price: %q", price))
+			}
+		}
+
+		if localPickup := field(row, "local_pickup"); localPickup != "" {
+			record.LocalPickup, err = strconv.ParseBool(localPickup)
+			if err != nil {
+				rowErrs[rowNum] = append(rowErrs[rowNum], fmt.Sprintf("invalid local_pickup: %q", localPickup))
+			}
+		}
+
+		if publishAt := field(row, "publish_at"); publishAt != "" {
+			t, err := time.Parse(time.RFC3339, publishAt)
+			if err != nil {
+				rowErrs[rowNum] = append(rowErrs[rowNum], fmt.Sprintf("invalid publish_at: %q", publishAt))
+			} else {
+				record.PublishAt = &t
+			}
+		}
+
+		for _, name := range strings.Split(field(row, "images"), ";") {
+			if name = strings.TrimSpace(name); name != "" {
+				record.Images = append(record.Images, name)
+			}
+		}
+
+		records = append(records, record)
+	}
+
+	return records, rowErrs, nil
+}
+
+// imageArchive indexes the files of an uploaded zip by base name so rows can
+// refer to images without caring about directories inside the archive.
+type imageArchive map[string]*zip.File
+
+func openImageArchive(file io.ReaderAt, size int64) (imageArchive, error) {
+	zr, err := zip.NewReader(file, size)
+	if err != nil {
+		return nil, fmt.Errorf("reading image archive: %v", err)
+	}
+
+	archive := make(imageArchive)
+	for _, f := range zr.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		archive[path.Base(f.Name)] = f
+	}
+	return archive, nil
+}
+
+func (a imageArchive) save(name string) (string, int64, error) {
+	f, ok := a[name]
+	if !ok {
+		return "", 0, fmt.Errorf("image %q not found in archive", name)
+	}
+	if f.UncompressedSize64 > maxFileSize {
+		return "", 0, fmt.Errorf("image %q exceeds the maximum file size", name)
+	}
+
+	rc, err := f.Open()
+	if err != nil {
+		return "", 0, err
+	}
+	defer rc.Close()
+
+	return saveImageFrom(rc)
+}
+
+// validateItemRecord applies the same rules as single item creation and
+// additionally checks that every referenced image is in the archive.
+func validateItemRecord(record *ItemRecord, archive imageArchive) (Item, []string) {
+	item := Item{
+		Title:       record.Title,
+		Description: record.Description,
+		Brand:       record.Brand,
+		Price:       record.Price,
+		Size:        record.Size,
+		Category:    record.Category,
+		Condition:   record.Condition,
+		LocalPickup: record.LocalPickup,
+		Status:      record.Status,
+		PublishAt:   record.PublishAt,
+	}
+
+	errs := validateItemFields(&item)
+	if err := validateListingStatus(&item); err != nil {
+		errs = append(errs, err.Error())
+	}
+
+	if len(record.Images) == 0 && item.Status != "draft" {
+		errs = append(errs, "at least one image required")
+	}
+	if len(record.Images) > maxImages {
+		errs = append(errs, fmt.Sprintf("maximum %d images allowed", maxImages))
+	}
+	for _, name := range record.Images {
+		if _, ok := archive[name]; !ok {
+			errs = append(errs, fmt.Sprintf("image %q not found in archive", name))
+		}
+	}
+
+	return item, errs
+}
+
+func importItemRecord(item Item, imageNames []string, archive imageArchive, sellerID string) (string, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	var itemID string
+	err = tx.QueryRow(`
+		INSERT INTO items (title, description, brand, price, size, category, condition, local_pickup,
+						   seller_id, quantity, status, publish_at)
+		VALUES ($1, $2, NULLIF($3, ''), $4, $5, $6, NULLIF($7, '')::item_condition_enum, $8,
+				$9, 1, $10::item_status_enum, $11)
+		RETURNING id`,
+		item.Title, item.Description, item.Brand, item.Price, item.Size, item.Category, item.Condition,
+		item.LocalPickup, sellerID, item.Status, item.PublishAt).Scan(&itemID)
+	if err != nil {
+		return "", err
+	}
+
+	var imagePaths []string
+	var imageIDs []string
+	committed := false
+	defer func() {
+		if !committed {
+			for _, path := range imagePaths {
+				removeImageFiles(path)
+			}
+		}
+	}()
+
+	for _, name := range imageNames {
+		imagePath, phash, err := archive.save(name)
+		if err != nil {
+			return "", err
+		}
+		imagePaths = append(imagePaths, imagePath)
+
+		var imageID string
+		err = tx.QueryRow(`
+			INSERT INTO item_images (item_id, image_path, phash)
+			VALUES ($1, $2, $3)
+			RETURNING id`,
+			itemID, imagePath, phash).Scan(&imageID)
+		if err != nil {
+			return "", err
+		}
+		imageIDs = append(imageIDs, imageID)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return "", err
+	}
+	committed = true
+
+	if _, err := flagDuplicateImages(sellerID, imageIDs); err != nil {
+		log.Printf("Error checking imported item %s for duplicate images: %v", itemID, err)
+	}
+	return itemID, nil
+}
+
+// importItemsHandler creates listings in bulk from a CSV or JSON file and an
+// optional zip of images. Each row is validated and imported independently;
+// the response reports the outcome of every row. With dry_run=true nothing
+// is written.
+func importItemsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, _ := getUserIDFromContext(r.Context())
+	dryRun := r.URL.Query().Get("dry_run") == "true"
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxImportSize)
+	if err := r.ParseMultipartForm(maxFileSize); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	file, fileHeader, err := r.FormFile("file")
+	if err != nil {
+		http.Error(w, "Listing file is required", http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+
+	format := r.FormValue("format")
+	if format == "" {
+		format = strings.TrimPrefix(strings.ToLower(filepath.Ext(fileHeader.Filename)), ".")
+	}
+
+	var records []ItemRecord
+	rowErrs := make(map[int][]string)
+	switch format {
+	case "csv":
+		records, rowErrs, err = parseItemRecordsCSV(file)
+	case "json":
+		err = json.NewDecoder(file).Decode(&records)
+	default:
+		err = fmt.Errorf("unsupported import format: %q", format)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if len(records) > maxImportRows {
+		http.Error(w, fmt.Sprintf("Maximum %d rows per import", maxImportRows), http.StatusBadRequest)
+		return
+	}
+
+	archive := make(imageArchive)
+	if imagesFile, imagesHeader, err := r.FormFile("images"); err == nil {
+		defer imagesFile.Close()
+		archive, err = openImageArchive(imagesFile, imagesHeader.Size)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	canPickup, err := hasPickupLocation(db, userID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	results := make([]ImportRowResult, 0, len(records))
+	var imported, failed int
+	for i := range records {
+		result := ImportRowResult{Row: i + 1}
+
+		item, errs := validateItemRecord(&records[i], archive)
+		result.Errors = append(rowErrs[result.Row], errs...)
+		if item.LocalPickup && !canPickup {
+			result.Errors = append(result.Errors, "local pickup requires a pickup location")
+		}
+
+		if len(result.Errors) == 0 && !dryRun {
+			result.ItemID, err = importItemRecord(item, records[i].Images, archive, userID)
+			if err != nil {
+				log.Printf("Error importing row %d: %v", result.Row, err)
+				result.Errors = append(result.Errors, err.Error())
+			}
+		}
+
+		if len(result.Errors) > 0 {
+			failed++
+		} else if !dryRun {
+			imported++
+		}
+		results = append(results, result)
+	}
+
+	sendJSON(w, map[string]interface{}{
+		"dry_run":  dryRun,
+		"imported": imported,
+		"failed":   failed,
+		"rows":     results,
+	})
+}
+
+// loadSellerItemRecords returns the seller's inventory in import format
+// together with the stored path of each referenced image.
+func loadSellerItemRecords(sellerID string) ([]ItemRecord, map[string]string, error) {
+	rows, err := db.Query(`
+		SELECT i.title, COALESCE(i.description, ''), COALESCE(i.brand, ''), i.price, i.size, i.category,
+			   COALESCE(i.condition::text, ''), i.local_pickup, i.status, i.publish_at,
+			   array_remove(array_agg(im.image_path ORDER BY im.created_at), NULL) as images
+		FROM items i
+		LEFT JOIN item_images im ON i.id = im.item_id
+		WHERE i.seller_id = $1 AND i.deleted_at IS NULL
+		GROUP BY i.id
+		ORDER BY i.created_at`,
+		sellerID)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	records := make([]ItemRecord, 0)
+	imagePaths := make(map[string]string)
+	for rows.Next() {
+		var record ItemRecord
+		var images []string
+		err := rows.Scan(&record.Title, &record.Description, &record.Brand, &record.Price,
+			&record.Size, &record.Category, &record.Condition, &record.LocalPickup, &record.Status, &record.PublishAt,
+			pq.Array(&images))
+		if err != nil {
+			return nil, nil, err
+		}
+
+		// Only live, draft and scheduled listings can be imported. Sold,
+		// reserved and paused ones come back as drafts for the seller to
+		// review instead of failing the import.
+		switch record.Status {
+		case "sold", "reserved", "paused":
+			record.Status = "draft"
+			record.PublishAt = nil
+		}
+
+		record.Images = make([]string, 0, len(images))
+		for _, imagePath := range images {
+			name := filepath.Base(imagePath)
+			record.Images = append(record.Images, name)
+			imagePaths[name] = imagePath
+		}
+		records = append(records, record)
+	}
+
+	return records, imagePaths, rows.Err()
+}
+
+func exportItemsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, _ := getUserIDFromContext(r.Context())
+
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "csv"
+	}
+	if format != "csv" && format != "json" {
+		http.Error(w, fmt.Sprintf("unsupported export format: %q", format), http.StatusBadRequest)
+		return
+	}
+
+	records, _, err := loadSellerItemRecords(userID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	filename := fmt.Sprintf("items-%s.%s", time.Now().Format("2006-01-02"), format)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+
+	if format == "json" {
+		sendJSON(w, records)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv")
+	writer := csv.NewWriter(w)
+	writer.Write(itemRecordColumns)
+	for _, record := range records {
+		var publishAt string
+		if record.PublishAt != nil {
+			publishAt = record.PublishAt.Format(time.RFC3339)
+		}
+		writer.Write([]string{
+			record.Title,
+			record.Description,
+			record.Brand,
+			strconv.FormatFloat(record.Price, 'f', 2, 64),
+			record.Size,
+			record.Category,
+			record.Condition,
+			strconv.FormatBool(record.LocalPickup),
+			record.Status,
+			publishAt,
+			strings.Join(record.Images, ";"),
+		})
+	}
+	writer.Flush()
+
+	if err := writer.Error(); err != nil {
+		log.Printf("Error writing CSV export: %v", err)
+	}
+}
+
+// exportItemImagesHandler streams a zip of the seller's images named as they
+// are referenced by the listing export, ready to be passed back to import.
+func exportItemImagesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, _ := getUserIDFromContext(r.Context())
+
+	_, imagePaths, err := loadSellerItemRecords(userID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Check every image before the response starts, since errors cannot be
+	// reported once part of the zip has been sent
+	for name, imagePath := range imagePaths {
+		_, err := blobs.Stat(imagePath)
+		if err == errBlobNotFound {
+			log.Printf("Skipping missing image %s in export", imagePath)
+			delete(imagePaths, name)
+			continue
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	filename := fmt.Sprintf("images-%s.zip", time.Now().Format("2006-01-02"))
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+
+	zw := zip.NewWriter(w)
+	for name, imagePath := range imagePaths {
+		if err := addBlobToZip(zw, name, imagePath); err != nil {
+			// Abort the connection so the client does not take a truncated
+			// zip for a complete one
+			log.Printf("Error adding %s to image export: %v", imagePath, err)
+			panic(http.ErrAbortHandler)
+		}
+	}
+
+	if err := zw.Close(); err != nil {
+		log.Printf("Error finishing image export: %v", err)
+	}
+}
+
+func addBlobToZip(zw *zip.Writer, name, key string) error {
+	src, err := blobs.Open(key)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := zw.Create(name)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(dst, src)
+	return err
+}
@@ -0,0 +1,713 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Listing lifecycle transitions a seller may make, keyed by the current status
+var listingTransitions = map[string][]string{
+	"draft":     {"available", "scheduled"},
+	"scheduled": {"available", "scheduled", "draft"},
+	"available": {"paused"},
+	"paused":    {"available", "scheduled", "draft"},
+}
+
+var validSizes = map[string]bool{
+	"XS": true, "S": true, "M": true, "L": true, "XL": true,
+}
+
+var validCategories = map[string]bool{
+	"tops": true, "bottoms": true, "outerwear": true, "footwear": true, "accessories": true,
+}
+
+var validConditions = map[string]bool{
+	"new_with_tags": true, "like_new": true, "good": true, "fair": true,
+}
+
+// validateItemFields checks the seller-provided fields of a listing against
+// the constraints of the items table and returns every problem found.
+func validateItemFields(item *Item) []string {
+	var errs []string
+
+	item.Title = strings.TrimSpace(item.Title)
+	if item.Title == "" {
+		errs = append(errs, "title is required")
+	} else if len(item.Title) > 255 {
+		errs = append(errs, "title must be at most 255 characters")
+	}
+
+	item.Brand = strings.TrimSpace(item.Brand)
+	if len(item.Brand) > 100 {
+		errs = append(errs, "brand must be at most 100 characters")
+	}
+
+	if item.Free {
+		if item.Price != 0 {
+			errs = append(errs, "free items must have a price of zero")
+		}
+	} else if item.Price <= 0 {
+		errs = append(errs, "price must be greater than zero")
+	} else if item.Price >= 1e8 {
+		errs = append(errs, "price is too large")
+	}
+
+	if !validSizes[item.Size] {
+		errs = append(errs, fmt.Sprintf("invalid size: %q", item.Size))
+	}
+
+	if !validCategories[item.Category] {
+		errs = append(errs, fmt.Sprintf("invalid category: %q", item.Category))
+	}
+
+	// Condition is optional since older listings were created without one
+	if item.Condition != "" && !validConditions[item.Condition] {
+		errs = append(errs, fmt.Sprintf("invalid condition: %q", item.Condition))
+	}
+
+	return errs
+}
+
+// validateListingStatus normalizes the status of a newly created listing.
+// Only live, draft and scheduled listings can be created directly.
+func validateListingStatus(item *Item) error {
+	switch item.Status {
+	case "", "available":
+		item.Status = "available"
+		item.PublishAt = nil
+	case "draft":
+		item.PublishAt = nil
+	case "scheduled":
+		if item.PublishAt == nil || !item.PublishAt.After(time.Now()) {
+			return fmt.Errorf("publish_at must be in the future for scheduled listings")
+		}
+	default:
+		return fmt.Errorf("invalid listing status: %s", item.Status)
+	}
+	return nil
+}
+
+func canTransitionListing(from, to string) bool {
+	for _, allowed := range listingTransitions[from] {
+		if allowed == to {
+			return true
+		}
+	}
+	return false
+}
+
+func updateItemStatusHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, _ := getUserIDFromContext(r.Context())
+	itemID := r.URL.Query().Get("id")
+
+	var req struct {
+		Status    string     `json:"status"`
+		PublishAt *time.Time `json:"publish_at"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var currentStatus string
+	var imageCount int
+	var held bool
+	err = tx.QueryRow(`
+		SELECT i.status,
+			   (SELECT COUNT(*) FROM item_images im WHERE im.item_id = i.id),
+			   i.moderation_hold
+		FROM items i
+		WHERE i.id = $1 AND i.seller_id = $2 AND i.deleted_at IS NULL
+		FOR UPDATE OF i`,
+		itemID, userID).Scan(&currentStatus, &imageCount, &held)
+
+	if err == sql.ErrNoRows {
+		http.Error(w, "Item not found or not authorized", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	bidOn, err := hasLiveBids(tx, itemID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if bidOn {
+		http.Error(w, "This item has bids in an open auction and cannot be changed", http.StatusBadRequest)
+		return
+	}
+
+	if !canTransitionListing(currentStatus, req.Status) {
+		http.Error(w, fmt.Sprintf("Cannot change listing from %s to %s", currentStatus, req.Status), http.StatusBadRequest)
+		return
+	}
+
+	switch req.Status {
+	case "scheduled":
+		if req.PublishAt == nil || !req.PublishAt.After(time.Now()) {
+			http.Error(w, "publish_at must be in the future for scheduled listings", http.StatusBadRequest)
+			return
+		}
+	default:
+		req.PublishAt = nil
+	}
+
+	if (req.Status == "available" || req.Status == "scheduled") && held {
+		http.Error(w, "This listing was paused by a moderator and cannot be published", http.StatusForbidden)
+		return
+	}
+
+	if (req.Status == "available" || req.Status == "scheduled") && imageCount == 0 {
+		http.Error(w, "At least one image required before publishing", http.StatusBadRequest)
+		return
+	}
+
+	_, err = tx.Exec(`
+		UPDATE items
+		SET status = $1::item_status_enum, publish_at = $2
+		WHERE id = $3`,
+		req.Status, req.PublishAt, itemID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Paused or unpublished listings stay in carts flagged as removed
+	if req.Status == "available" && currentStatus == "paused" {
+		if err := notifyFavoritesBackInStock(tx, []string{itemID}); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	sendJSON(w, map[string]interface{}{
+		"id":         itemID,
+		"status":     req.Status,
+		"publish_at": req.PublishAt,
+	})
+}
+
+func updateItemPriceHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, _ := getUserIDFromContext(r.Context())
+	itemID := r.URL.Query().Get("id")
+
+	var req struct {
+		Price float64 `json:"price"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if req.Price <= 0 {
+		http.Error(w, "price must be greater than zero", http.StatusBadRequest)
+		return
+	}
+	if req.Price >= 1e8 {
+		http.Error(w, "price is too large", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var title, status string
+	var oldPrice float64
+	var free bool
+	err = tx.QueryRow(`
+		SELECT title, price, status, is_free
+		FROM items
+		WHERE id = $1 AND seller_id = $2 AND deleted_at IS NULL
+		FOR UPDATE`,
+		itemID, userID).Scan(&title, &oldPrice, &status, &free)
+
+	if err == sql.ErrNoRows {
+		http.Error(w, "Item not found or not authorized", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if status == "sold" {
+		http.Error(w, "Cannot change the price of a sold item", http.StatusBadRequest)
+		return
+	}
+	if free {
+		http.Error(w, "Cannot set a price on a free item", http.StatusBadRequest)
+		return
+	}
+
+	var newPrice float64
+	err = tx.QueryRow(`
+		UPDATE items SET price = $1
+		WHERE id = $2
+		RETURNING price`,
+		req.Price, itemID).Scan(&newPrice)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Drafts and paused listings have nobody to tell until they go live
+	if newPrice < oldPrice && status == "available" {
+		if err := notifyFavoritesPriceDrop(tx, itemID, title, oldPrice, newPrice); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	sendJSON(w, map[string]interface{}{
+		"id":    itemID,
+		"price": newPrice,
+	})
+}
+
+// addItemImagesHandler attaches photos to an existing listing, typically a
+// draft that was saved before the seller had any images.
+func addItemImagesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, _ := getUserIDFromContext(r.Context())
+	itemID := r.URL.Query().Get("id")
+
+	if err := r.ParseMultipartForm(maxFileSize); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	files := r.MultipartForm.File["images"]
+	if len(files) == 0 {
+		http.Error(w, "At least one image required", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var imageCount int
+	err = tx.QueryRow(`
+		SELECT (SELECT COUNT(*) FROM item_images im WHERE im.item_id = i.id)
+		FROM items i
+		WHERE i.id = $1 AND i.seller_id = $2 AND i.deleted_at IS NULL
+		FOR UPDATE OF i`,
+		itemID, userID).Scan(&imageCount)
+
+	if err == sql.ErrNoRows {
+		http.Error(w, "Item not found or not authorized", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if imageCount+len(files) > maxImages {
+		http.Error(w, fmt.Sprintf("Maximum %d images allowed", maxImages), http.StatusBadRequest)
+		return
+	}
+
+	// Files written before a failure would otherwise be left without rows
+	var imagePaths []string
+	var imageIDs []string
+	committed := false
+	defer func() {
+		if !committed {
+			for _, path := range imagePaths {
+				removeImageFiles(path)
+			}
+		}
+	}()
+
+	for _, fileHeader := range files {
+		imagePath, phash, err := saveImage(fileHeader)
+		if errors.Is(err, errInvalidImage) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		imagePaths = append(imagePaths, imagePath)
+
+		var imageID string
+		err = tx.QueryRow(`
+			INSERT INTO item_images (item_id, image_path, phash)
+			VALUES ($1, $2, $3)
+			RETURNING id`,
+			itemID, imagePath, phash).Scan(&imageID)
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		imageIDs = append(imageIDs, imageID)
+	}
+
+	if err = tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	committed = true
+
+	if _, err := flagDuplicateImages(userID, imageIDs); err != nil {
+		log.Printf("Error checking item %s for duplicate images: %v", itemID, err)
+	}
+
+	sendJSON(w, map[string]interface{}{
+		"id":     itemID,
+		"images": imagePaths,
+	})
+}
+
+// publishDueListings makes scheduled listings live once their publish time
+// has passed.
+func publishDueListings() (int64, error) {
+	result, err := db.Exec(`
+		UPDATE items
+		SET status = 'available'::item_status_enum, publish_at = NULL
+		WHERE status = 'scheduled' AND NOT moderation_hold
+		AND deleted_at IS NULL
+		AND publish_at <= CURRENT_TIMESTAMP
+		AND EXISTS (SELECT 1 FROM item_images im WHERE im.item_id = items.id)`)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func startListingScheduler(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		published, err := publishDueListings()
+		if err != nil {
+			log.Printf("Error publishing scheduled listings: %v", err)
+			continue
+		}
+		if published > 0 {
+			log.Printf("Published %d scheduled listings", published)
+		}
+	}
+}
+
+// duplicateItemHandler creates a new draft from one of the seller's
+// listings. Image files are copied rather than shared so that deleting
+// either listing leaves the other's images intact.
+func duplicateItemHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, _ := getUserIDFromContext(r.Context())
+	itemID := strings.TrimPrefix(r.URL.Path, "/items/")
+	itemID = strings.TrimSuffix(itemID, "/duplicate")
+
+	source, err := getItemByID(itemID)
+	if err == sql.ErrNoRows || (err == nil && source.SellerID != userID) {
+		http.Error(w, "Item not found or not authorized", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var newItemID string
+	err = tx.QueryRow(`
+		INSERT INTO items (title, description, brand, price, size, category, condition, local_pickup,
+						   seller_id, quantity, status, is_free, free_first_come)
+		VALUES ($1, $2, NULLIF($3, ''), $4, $5, $6, NULLIF($7, '')::item_condition_enum, $8,
+				$9, 1, 'draft'::item_status_enum, $10, $11)
+		RETURNING id`,
+		source.Title, source.Description, source.Brand, source.Price, source.Size, source.Category,
+		source.Condition, source.LocalPickup, userID, source.Free, source.FirstCome).Scan(&newItemID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var copiedPaths []string
+	cleanup := func() {
+		for _, path := range copiedPaths {
+			removeImageFiles(path)
+		}
+	}
+
+	for _, imagePath := range source.Images {
+		copiedPath, err := copyImage(imagePath)
+		if err != nil {
+			cleanup()
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		copiedPaths = append(copiedPaths, copiedPath)
+
+		_, err = tx.Exec(`
+			INSERT INTO item_images (item_id, image_path, phash)
+			SELECT $1, $2, phash FROM item_images
+			WHERE item_id = $3 AND image_path = $4`,
+			newItemID, copiedPath, source.ID, imagePath)
+		if err != nil {
+			cleanup()
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// A duplicated bundle groups whichever of its items are still for sale
+	_, err = tx.Exec(`
+		INSERT INTO bundle_items (bundle_id, item_id)
+		SELECT $1, b.item_id FROM bundle_items b
+		JOIN items i ON b.item_id = i.id
+		WHERE b.bundle_id = $2 AND i.status <> 'sold' AND i.deleted_at IS NULL`,
+		newItemID, source.ID)
+	if err != nil {
+		cleanup()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err = tx.Commit(); err != nil {
+		cleanup()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	duplicate, err := getItemByID(newItemID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	sendJSON(w, duplicate)
+}
+
+// copyImage stores a new copy of an existing upload and its thumbnails and
+// returns the new path
+func copyImage(imagePath string) (string, error) {
+	copiedPath := filepath.Join("uploads", uuid.New().String()+filepath.Ext(imagePath))
+
+	if err := copyBlob(imagePath, copiedPath); err != nil {
+		return "", err
+	}
+
+	for variant := range imageVariants {
+		err := copyBlob(imageVariantPath(imagePath, variant), imageVariantPath(copiedPath, variant))
+		if err != nil && err != errBlobNotFound {
+			removeImageFiles(copiedPath)
+			return "", err
+		}
+	}
+
+	return copiedPath, nil
+}
+
+func restoreItemHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, _ := getUserIDFromContext(r.Context())
+	itemID := r.URL.Query().Get("id")
+
+	result, err := db.Exec(`
+		UPDATE items
+		SET deleted_at = NULL
+		WHERE id = $1 AND seller_id = $2 AND deleted_at > $3`,
+		itemID, userID, time.Now().Add(-itemRestoreGracePeriod))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if rowsAffected == 0 {
+		http.Error(w, "Item not found or can no longer be restored", http.StatusNotFound)
+		return
+	}
+
+	item, err := getItemByID(itemID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	sendJSON(w, item)
+}
+
+// purgeDeletedItems permanently removes items whose restore grace period has
+// expired. Items that appear in orders keep their row so order history stays
+// intact; only their images are removed.
+func purgeDeletedItems() (int, error) {
+	rows, err := db.Query(`
+		SELECT i.id FROM items i
+		WHERE i.deleted_at < $1
+		AND (
+				EXISTS (SELECT 1 FROM item_images im WHERE im.item_id = i.id)
+				OR NOT EXISTS (SELECT 1 FROM order_items oi WHERE oi.item_id = i.id)
+		)`,
+		time.Now().Add(-itemRestoreGracePeriod))
+	if err != nil {
+		return 0, err
+	}
+
+	var itemIDs []string
+	for rows.Next() {
+		var itemID string
+		if err := rows.Scan(&itemID); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		itemIDs = append(itemIDs, itemID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	purged := 0
+	for _, itemID := range itemIDs {
+		if err := purgeItem(itemID); err != nil {
+			log.Printf("Error purging item %s: %v", itemID, err)
+			continue
+		}
+		purged++
+	}
+	return purged, nil
+}
+
+func purgeItem(itemID string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`
+		DELETE FROM item_images
+		WHERE item_id = $1
+		RETURNING image_path`,
+		itemID)
+	if err != nil {
+		return err
+	}
+
+	var imagePaths []string
+	for rows.Next() {
+		var path string
+		if err := rows.Scan(&path); err != nil {
+			rows.Close()
+			return err
+		}
+		imagePaths = append(imagePaths, path)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
+		DELETE FROM items
+		WHERE id = $1
+		AND NOT EXISTS (SELECT 1 FROM order_items oi WHERE oi.item_id = items.id)`,
+		itemID)
+	if err != nil {
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+
+	// Files are only removed once the rows referencing them are gone
+	for _, path := range imagePaths {
+		if err := removeImageFiles(path); err != nil {
+			log.Printf("Error removing image %s: %v", path, err)
+		}
+	}
+	return nil
+}
+
+func startItemPurger(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		purged, err := purgeDeletedItems()
+		if err != nil {
+			log.Printf("Error purging deleted items: %v", err)
+			continue
+		}
+		if purged > 0 {
+			log.Printf("Purged %d deleted items", purged)
+		}
+	}
+}
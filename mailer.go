@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"mime"
+	"net/smtp"
+	"os"
+	"strings"
+)
+
+// Mailer sends plain text emails to users
+type Mailer interface {
+	Send(to, subject, body string) error
+}
+
+var mailer Mailer
+
+// logMailer writes emails to the log. It is used when no SMTP server is
+// configured so development setups need no mail server.
+type logMailer struct{}
+
+func (logMailer) Send(to, subject, body string) error {
+	log.Printf("Email to %s: %s\n%s", to, subject, body)
+	return nil
+}
+
+type smtpMailer struct {
+	Addr string
+	From string
+	Auth smtp.Auth
+}
+
+// headerLineBreaks turns line breaks into spaces so text from users, such
+// as saved search names, cannot start new headers
+var headerLineBreaks = strings.NewReplacer("\r\n", " ", "\r", " ", "\n", " ")
+
+func (m *smtpMailer) Send(to, subject, body string) error {
+	subject = mime.QEncoding.Encode("utf-8", headerLineBreaks.Replace(subject))
+	msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nContent-Type: text/plain; charset=UTF-8\r\n\r\n%s",
+		m.From, to, subject, strings.ReplaceAll(body, "\n", "\r\n"))
+	return smtp.SendMail(m.Addr, m.Auth, m.From, []string{to}, []byte(msg))
+}
+
+func initMailer() {
+	host := os.Getenv("SMTP_HOST")
+	if host == "" {
+		mailer = logMailer{}
+		return
+	}
+
+	port := os.Getenv("SMTP_PORT")
+	if port == "" {
+		port = "587"
+	}
+
+	from := os.Getenv("SMTP_FROM")
+	if from == "" {
+		log.Fatal("SMTP_FROM is required when SMTP_HOST is set")
+	}
+
+	m := &smtpMailer{Addr: host + ":" + port, From: from}
+	if username := os.Getenv("SMTP_USERNAME"); username != "" {
+		m.Auth = smtp.PlainAuth("", username, os.Getenv("SMTP_PASSWORD"), host)
+	}
+	mailer = m
+}
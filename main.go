@@ -4,6 +4,7 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -11,6 +12,7 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
@@ -35,18 +37,52 @@ type User struct {
 }
 
 type Item struct {
-	ID          string    `json:"id"`
-	Title       string    `json:"title"`
-	Description string    `json:"description"`
-	Price       float64   `json:"price"`
-	Size        string    `json:"size"`
-	Category    string    `json:"category"`
-	Status      string    `json:"status"`
-	Quantity    int       `json:"quantity"`
-	SellerID    string    `json:"seller_id"`
-	SellerName  string    `json:"seller_name"`
-	Images      []string  `json:"images"`
-	CreatedAt   time.Time `json:"created_at"`
+	ID          string     `json:"id"`
+	Title       string     `json:"title"`
+	Description string     `json:"description"`
+	Brand       string     `json:"brand"`
+	Price       float64    `json:"price"`
+	Size        string     `json:"size"`
+	Category    string     `json:"category"`
+	Condition   string     `json:"condition,omitempty"`
+	LocalPickup bool       `json:"local_pickup"`
+	Status      string     `json:"status"`
+	Quantity    int        `json:"quantity"`
+	SellerID    string     `json:"seller_id"`
+	SellerName  string     `json:"seller_name"`
+	Images      []string   `json:"images"`
+	PublishAt   *time.Time `json:"publish_at,omitempty"`
+	DeletedAt   *time.Time `json:"deleted_at,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+	// IDs of the images in the same order, served at /images/{id}
+	ImageIDs []string `json:"image_ids"`
+	// Highlighted excerpt matching the search query, only set by search
+	Snippet string `json:"snippet,omitempty"`
+	// Set on search results found by spelling similarity rather than an
+	// exact word match
+	FuzzyMatch bool `json:"fuzzy_match,omitempty"`
+	// Distance to the pickup location, only set when searching near a postcode
+	DistanceKm *float64 `json:"distance_km,omitempty"`
+	// Number of users who saved the item to their favorites
+	FavoritesCount int `json:"favorites_count"`
+	// When the seller last lowered the price, unless raised again since
+	PriceReducedAt *time.Time `json:"price_reduced_at,omitempty"`
+	// Set in the cart when an accepted offer replaces the listed price
+	OfferID string `json:"offer_id,omitempty"`
+	// Multi-buy discount included in the price, only set in the cart
+	DiscountPercent float64 `json:"discount_percent,omitempty"`
+	// Listings sold together as this bundle
+	BundleItemIDs []string `json:"bundle_item_ids,omitempty"`
+	// Free items are given away through a request queue instead of the
+	// cart. With FirstCome set the first request gets the item.
+	Free      bool `json:"free"`
+	FirstCome bool `json:"first_come,omitempty"`
+	// Open auction of the item, which can then only be bought by bidding
+	AuctionID string `json:"auction_id,omitempty"`
+	// Listed price when the item was put in the cart and what changed
+	// since, only set in the cart
+	PriceAtAdd *float64 `json:"price_at_add,omitempty"`
+	CartStatus string   `json:"cart_status,omitempty"`
 }
 
 type Order struct {
@@ -90,11 +126,12 @@ type OrderItem struct {
 }
 
 type Message struct {
-	ID        string    `json:"id"`
-	OrderID   string    `json:"order_id"`
-	SenderID  string    `json:"sender_id"`
-	Message   string    `json:"message"`
-	CreatedAt time.Time `json:"created_at"`
+	ID          string    `json:"id"`
+	OrderID     string    `json:"order_id"`
+	SenderID    string    `json:"sender_id"`
+	Message     string    `json:"message"`
+	IsAutoReply bool      `json:"is_auto_reply"`
+	CreatedAt   time.Time `json:"created_at"`
 }
 
 type UnreadMessage struct {
@@ -110,6 +147,12 @@ const (
 	maxFileSize = 10 << 20 // 10MB
 	maxImages   = 3
 	uploadDir   = "./uploads"
+
+	// How long a deleted item can be restored before its images are purged
+	itemRestoreGracePeriod = 30 * 24 * time.Hour
+
+	// Lifetime of image URLs handed out by blob stores that sign them
+	signedImageURLExpiry = 15 * time.Minute
 )
 
 var db *sql.DB
@@ -154,34 +197,43 @@ func sendJSON(w http.ResponseWriter, data interface{}) {
 	}
 }
 
-func saveImage(fileHeader *multipart.FileHeader) (string, error) {
+func saveImage(fileHeader *multipart.FileHeader) (string, int64, error) {
 	file, err := fileHeader.Open()
 	if err != nil {
-		return "", err
+		return "", 0, err
 	}
 	defer file.Close()
 
-	if err := os.MkdirAll(uploadDir, 0755); err != nil {
-		return "", err
+	return saveImageFrom(file)
+}
+
+// saveImageFrom validates and normalizes an uploaded image, then stores it
+// as a JPEG under a new unique name along with its thumbnail variants.
+// Re-encoding drops all EXIF metadata, including GPS coordinates. The
+// image's perceptual hash is returned for duplicate detection.
+func saveImageFrom(file io.Reader) (string, int64, error) {
+	img, err := decodeUpload(file)
+	if err != nil {
+		return "", 0, err
 	}
 
-	filename := fmt.Sprintf("%s%s",
-		uuid.New().String(), filepath.Ext(fileHeader.Filename))
+	// Relative path for database storage, also used as the blob key
+	imagePath := filepath.Join("uploads", uuid.New().String()+".jpg")
 
-	// Save to full path
-	fullPath := filepath.Join(uploadDir, filename)
-	dst, err := os.Create(fullPath)
-	if err != nil {
-		return "", err
+	if err := storeJPEG(imagePath, resizeToFit(img, maxImageDimension)); err != nil {
+		removeImageFiles(imagePath)
+		return "", 0, err
 	}
-	defer dst.Close()
 
-	if _, err = io.Copy(dst, file); err != nil {
-		return "", err
+	for variant, maxEdge := range imageVariants {
+		variantPath := imageVariantPath(imagePath, variant)
+		if err := storeJPEG(variantPath, resizeToFit(img, maxEdge)); err != nil {
+			removeImageFiles(imagePath)
+			return "", 0, err
+		}
 	}
 
-	// Return relative path for database storage
-	return filepath.Join("uploads", filename), nil
+	return imagePath, perceptualHash(img), nil
 }
 
 // Auth Handlers
@@ -318,103 +370,167 @@ func getUserNameHandler(w http.ResponseWriter, r *http.Request) {
 
 // Item Handlers
 func searchItemsHandler(w http.ResponseWriter, r *http.Request) {
-	query := strings.ToLower(r.URL.Query().Get("q"))
-	category := r.URL.Query().Get("category")
-	size := r.URL.Query().Get("size")
-	minPrice := r.URL.Query().Get("min_price")
-	maxPrice := r.URL.Query().Get("max_price")
+	filters, tsQuery := searchFiltersFromQuery(r.URL.Query())
 
-	sqlQuery := `
-      SELECT i.id, i.title, i.description, i.price, i.size, i.category,
-             i.status, i.quantity, i.seller_id, u.name as seller_name,
-             i.created_at, array_agg(im.image_path) as images
-      FROM items i
-      LEFT JOIN item_images im ON i.id = im.item_id
-      JOIN users u ON i.seller_id = u.id
-      WHERE 1=1`
+	origin, radiusKm, err := searchOriginFromQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	var params []interface{}
-	paramCount := 1
+	// Searching near a postcode only finds listings that can be collected
+	distanceSelect := `NULL::double precision as distance_km`
+	var distanceExpr string
+	if origin != nil {
+		distanceExpr = distanceKmSQL(*origin)
+		distanceSelect = distanceExpr + ` as distance_km`
+		filters = append(filters, searchDistanceFilter(*origin, radiusKm))
+	}
+
+	sortBy := r.URL.Query().Get("sort")
+	if sortBy == "" || (sortBy == "relevance" && tsQuery == "") || (sortBy == "distance" && origin == nil) {
+		switch {
+		case tsQuery != "":
+			sortBy = "relevance"
+		case origin != nil:
+			sortBy = "distance"
+		default:
+			sortBy = "newest"
+		}
+	}
+	keys, ok := searchSortKeys[sortBy]
+	if sortBy == "distance" {
+		keys, ok = searchDistanceKeys(distanceExpr), true
+	}
+	if !ok {
+		http.Error(w, "Invalid sort", http.StatusBadRequest)
+		return
+	}
 
-	if query != "" {
-		sqlQuery += fmt.Sprintf(` AND (LOWER(i.title) LIKE $%d OR LOWER(i.description) LIKE $%d)`, paramCount, paramCount)
-		params = append(params, "%"+query+"%")
-		paramCount++
+	page, err := parsePageRequest(r, "search:"+sortBy, keys)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
 
-	if category != "" {
-		sqlQuery += fmt.Sprintf(` AND i.category = $%d`, paramCount)
-		params = append(params, category)
-		paramCount++
+	rankSelect := `0::real as rank, '' as snippet`
+	if tsQuery != "" {
+		rankSelect = `ts_rank(i.search_vector, to_tsquery('english', $1)) as rank,
+             ts_headline('english', ` + searchHeadlineText + `,
+                         to_tsquery('english', $1), '` + searchHeadlineOptions + `') as snippet`
 	}
+	rankSelect += `,
+             ` + distanceSelect
+
+	filterSQL, params := searchFilterSQL(filters, "")
+	paramCount := len(params) + 1
+	baseWhere := `
+      WHERE ` + searchableItemsSQL + filterSQL
 
-	if size != "" {
-		sqlQuery += fmt.Sprintf(` AND i.size = $%d`, paramCount)
-		params = append(params, size)
-		paramCount++
+	total, err := page.countTotal(`SELECT COUNT(*) FROM items i`+baseWhere, params...)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
 
-	if minPrice != "" {
-		sqlQuery += fmt.Sprintf(` AND i.price >= $%d`, paramCount)
-		params = append(params, minPrice)
-		paramCount++
+	// Facets describe the whole result set, so only the first page has them
+	var facets *SearchFacets
+	if r.URL.Query().Get("facets") == "true" && page.after == nil {
+		facets, err = searchFacets(filters)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
 	}
 
-	if maxPrice != "" {
-		sqlQuery += fmt.Sprintf(` AND i.price <= $%d`, paramCount)
-		params = append(params, maxPrice)
-		paramCount++
+	pageWhere := baseWhere
+	if cond, args := page.where(keys, paramCount); cond != "" {
+		pageWhere += " AND " + cond
+		params = append(params, args...)
 	}
 
-	sqlQuery += ` GROUP BY i.id, u.name
-              ORDER BY
-                (CASE WHEN i.quantity > 0 THEN 0 ELSE 1 END),
-                i.created_at DESC`
+	sqlQuery := `
+      SELECT ` + searchItemColumns + `,
+             ` + rankSelect + `
+      FROM items i
+      LEFT JOIN item_images im ON i.id = im.item_id
+      JOIN users u ON i.seller_id = u.id` + pageWhere + `
+      GROUP BY i.id, u.name
+      ORDER BY ` + orderByKeys(keys) + page.limitClause()
 
 	rows, err := db.Query(sqlQuery, params...)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	defer rows.Close()
-
-	var items []Item
-	for rows.Next() {
-		var item Item
-		var images []sql.NullString
-		err := rows.Scan(
-			&item.ID, &item.Title, &item.Description, &item.Price,
-			&item.Size, &item.Category, &item.Status, &item.Quantity,
-			&item.SellerID, &item.SellerName, &item.CreatedAt, pq.Array(&images))
+	items, ranks, err := scanSearchItems(rows)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 
+	result := SearchPage{Page: Page{Total: total}, Facets: facets}
+	if page.hasMore(len(items)) {
+		items = items[:page.limit]
+		last := items[len(items)-1]
+		stock := "0"
+		if last.Quantity <= 0 {
+			stock = "1"
+		}
+		var distance, reducedAt string
+		if last.DistanceKm != nil {
+			distance = strconv.FormatFloat(*last.DistanceKm, 'g', -1, 64)
+		}
+		if last.PriceReducedAt != nil {
+			reducedAt = last.PriceReducedAt.Format(time.RFC3339Nano)
+		}
+		result.NextCursor = page.nextCursor(keys, map[string]string{
+			"stock":      stock,
+			"rank":       strconv.FormatFloat(float64(ranks[page.limit-1]), 'g', -1, 32),
+			"distance":   distance,
+			"price":      strconv.FormatFloat(last.Price, 'f', 2, 64),
+			"reduced_at": reducedAt,
+			"created_at": last.CreatedAt.Format(time.RFC3339Nano),
+			"id":         last.ID,
+		})
+	} else if tsQuery != "" && page.after == nil && len(items) < fuzzySearchThreshold {
+		// Too few exact matches, probably a typo: add close spellings after
+		// the exact results and suggest a corrected query
+		query := r.URL.Query().Get("q")
+		fuzzy, err := fuzzySearchItems(query, filters, distanceSelect, items, page.limit-len(items))
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
+		items = append(items, fuzzy...)
 
-		item.Images = make([]string, 0)
-		for _, img := range images {
-			if img.Valid {
-				item.Images = append(item.Images, img.String)
-			}
+		result.DidYouMean, err = didYouMean(query)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
 		}
-
-		items = append(items, item)
 	}
+	result.Items = items
 
-	sendJSON(w, items)
+	sendJSON(w, result)
 }
 
 func createOrderNotification(orderID, userID, message string) error {
-	_, err := db.Exec(`
+	return createNotification(db, userID, "order_status", orderID, message)
+}
+
+// createNotification sends the user a notification of the given kind about
+// the order, offer, trade or other record refID
+func createNotification(e execer, userID, kind, refID, message string) error {
+	_, err := e.Exec(`
 			INSERT INTO notifications (
 					user_id,
 					type,
 					reference_id,
 					message,
 					read
-			) VALUES ($1, 'order_status', $2, $3, false)`,
-		userID, orderID, message)
+			) VALUES ($1, $2, $3, $4, false)`,
+		userID, kind, refID, message)
 	return err
 }
 
@@ -441,8 +557,31 @@ func createItemWithImagesHandler(w http.ResponseWriter, r *http.Request) {
 	item.Quantity = 1
 	log.Printf("Setting initial quantity to: %d", item.Quantity)
 
+	if errs := validateItemFields(&item); len(errs) > 0 {
+		http.Error(w, strings.Join(errs, "; "), http.StatusBadRequest)
+		return
+	}
+
+	if err := validateListingStatus(&item); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if item.LocalPickup {
+		ok, err := hasPickupLocation(db, userID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			http.Error(w, "Set a pickup location before offering local pickup", http.StatusBadRequest)
+			return
+		}
+	}
+
 	files := r.MultipartForm.File["images"]
-	if len(files) == 0 {
+	// Drafts may be saved before the seller has taken any photos
+	if len(files) == 0 && item.Status != "draft" {
 		http.Error(w, "At least one image required", http.StatusBadRequest)
 		return
 	}
@@ -460,10 +599,13 @@ func createItemWithImagesHandler(w http.ResponseWriter, r *http.Request) {
 
 	var itemID string
 	err = tx.QueryRow(`
-        INSERT INTO items (title, description, price, size, category, seller_id, quantity, status)
-        VALUES ($1, $2, $3, $4, $5, $6, COALESCE($7, 1), 'available'::item_status_enum)
+        INSERT INTO items (title, description, brand, price, size, category, condition, local_pickup,
+                           seller_id, quantity, status, publish_at, is_free, free_first_come)
+        VALUES ($1, $2, NULLIF($3, ''), $4, $5, $6, NULLIF($7, '')::item_condition_enum, $8,
+                $9, COALESCE($10, 1), $11::item_status_enum, $12, $13, $14)
         RETURNING id, quantity`,
-		item.Title, item.Description, item.Price, item.Size, item.Category, userID, item.Quantity).Scan(&itemID, &item.Quantity)
+		item.Title, item.Description, item.Brand, item.Price, item.Size, item.Category, item.Condition,
+		item.LocalPickup, userID, item.Quantity, item.Status, item.PublishAt, item.Free, item.FirstCome).Scan(&itemID, &item.Quantity)
 
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Error inserting item: %v", err), http.StatusInternalServerError)
@@ -485,61 +627,122 @@ func createItemWithImagesHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	if len(item.BundleItemIDs) > 0 {
+		userErr, err := addBundleItems(tx, itemID, userID, item.BundleItemIDs)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if userErr != "" {
+			http.Error(w, userErr, http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Files written before a failure would otherwise be left without rows
 	var imagePaths []string
+	var imageIDs []string
+	committed := false
+	defer func() {
+		if !committed {
+			for _, path := range imagePaths {
+				removeImageFiles(path)
+			}
+		}
+	}()
+
 	for _, fileHeader := range files {
-		imagePath, err := saveImage(fileHeader)
+		imagePath, phash, err := saveImage(fileHeader)
+		if errors.Is(err, errInvalidImage) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 		imagePaths = append(imagePaths, imagePath)
 
-		_, err = tx.Exec(`
-			INSERT INTO item_images (item_id, image_path)
-			VALUES ($1, $2)`,
-			itemID, imagePath)
+		var imageID string
+		err = tx.QueryRow(`
+			INSERT INTO item_images (item_id, image_path, phash)
+			VALUES ($1, $2, $3)
+			RETURNING id`,
+			itemID, imagePath, phash).Scan(&imageID)
 
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
+		imageIDs = append(imageIDs, imageID)
 	}
 
 	if err = tx.Commit(); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	committed = true
 
-	var createdItem Item
-	var images []sql.NullString
-	err = db.QueryRow(`
-		SELECT i.id, i.title, i.description, i.price, i.size,
-			   i.category, i.status, i.quantity, i.seller_id, u.name as seller_name, i.created_at,
-			   array_agg(im.image_path) as images
+	if flagged, err := flagDuplicateImages(userID, imageIDs); err != nil {
+		log.Printf("Error checking item %s for duplicate images: %v", itemID, err)
+	} else if flagged > 0 {
+		log.Printf("Flagged %d possible duplicate images on item %s", flagged, itemID)
+	}
+
+	createdItem, err := getItemByID(itemID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	sendJSON(w, createdItem)
+}
+
+// itemImagesSQL aggregates the images im of item i in upload order, as
+// paths and as IDs, for setItemImages
+const itemImagesSQL = `array_agg(im.image_path ORDER BY im.created_at, im.id) as images,
+			   array_agg(im.id::text ORDER BY im.created_at, im.id) as image_ids`
+
+// setItemImages fills in the images aggregated by itemImagesSQL. Items
+// without images aggregate a single NULL from the outer join.
+func setItemImages(item *Item, paths, ids []sql.NullString) {
+	item.Images = make([]string, 0)
+	item.ImageIDs = make([]string, 0)
+	for i, path := range paths {
+		if path.Valid && i < len(ids) {
+			item.Images = append(item.Images, path.String)
+			item.ImageIDs = append(item.ImageIDs, ids[i].String)
+		}
+	}
+}
+
+func getItemByID(itemID string) (Item, error) {
+	var item Item
+	var images, imageIDs []sql.NullString
+	err := db.QueryRow(`
+		SELECT i.id, i.title, i.description, COALESCE(i.brand, ''), i.price, i.size,
+			   i.category, COALESCE(i.condition::text, ''), i.local_pickup, i.status, i.quantity, i.seller_id, u.name as seller_name,
+			   i.publish_at, i.created_at, `+favoritesCountSQL+`, `+bundleItemIDsSQL+`,
+			   i.is_free, i.free_first_come, `+openAuctionIDSQL+`, `+itemImagesSQL+`
 		FROM items i
 		LEFT JOIN item_images im ON i.id = im.item_id
 		JOIN users u ON i.seller_id = u.id
-		WHERE i.id = $1
+		WHERE i.id = $1 AND i.deleted_at IS NULL
 		GROUP BY i.id, u.name`,
 		itemID).Scan(
-		&createdItem.ID, &createdItem.Title, &createdItem.Description,
-		&createdItem.Price, &createdItem.Size, &createdItem.Category,
-		&createdItem.Status, &createdItem.Quantity, &createdItem.SellerID,
-		&createdItem.SellerName, &createdItem.CreatedAt, pq.Array(&images))
+		&item.ID, &item.Title, &item.Description, &item.Brand,
+		&item.Price, &item.Size, &item.Category, &item.Condition, &item.LocalPickup,
+		&item.Status, &item.Quantity, &item.SellerID,
+		&item.SellerName, &item.PublishAt, &item.CreatedAt, &item.FavoritesCount, pq.Array(&item.BundleItemIDs),
+		&item.Free, &item.FirstCome, &item.AuctionID, pq.Array(&images), pq.Array(&imageIDs))
 
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return item, err
 	}
 
-	createdItem.Images = make([]string, 0)
-	for _, img := range images {
-		if img.Valid {
-			createdItem.Images = append(createdItem.Images, img.String)
-		}
-	}
+	setItemImages(&item, images, imageIDs)
 
-	sendJSON(w, createdItem)
+	return item, nil
 }
 
 // Cart Handlers
@@ -556,7 +759,11 @@ func addToCartHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Check if user is the seller
 	var sellerID string
-	err := db.QueryRow(`SELECT seller_id FROM items WHERE id = $1`, req.ItemID).Scan(&sellerID)
+	err := db.QueryRow(`SELECT seller_id FROM items WHERE id = $1 AND deleted_at IS NULL`, req.ItemID).Scan(&sellerID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Item not found or unavailable", http.StatusNotFound)
+		return
+	}
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -567,6 +774,16 @@ func addToCartHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	vacation, err := getActiveVacation(db, sellerID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if vacation != nil {
+		http.Error(w, fmt.Sprintf("Seller is on vacation until %s", vacation.EndsAt.Format("2 January 2006")), http.StatusBadRequest)
+		return
+	}
+
 	tx, err := db.Begin()
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -575,10 +792,11 @@ func addToCartHandler(w http.ResponseWriter, r *http.Request) {
 	defer tx.Rollback()
 
 	var quantity int
+	var free bool
 	err = tx.QueryRow(`
-      SELECT quantity FROM items
-      WHERE id = $1 AND status = 'available'`,
-		req.ItemID).Scan(&quantity)
+      SELECT quantity, is_free FROM items
+      WHERE id = $1 AND status = 'available' AND deleted_at IS NULL`,
+		req.ItemID).Scan(&quantity, &free)
 
 	if err == sql.ErrNoRows {
 		http.Error(w, "Item not found or unavailable", http.StatusNotFound)
@@ -589,6 +807,21 @@ func addToCartHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if free {
+		http.Error(w, "Free items must be requested from the giver", http.StatusBadRequest)
+		return
+	}
+
+	auctioned, err := anyInOpenAuction(tx, []string{req.ItemID})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if auctioned {
+		http.Error(w, "This item is being auctioned, place a bid instead", http.StatusBadRequest)
+		return
+	}
+
 	if quantity <= 0 {
 		http.Error(w, "Item out of stock", http.StatusBadRequest)
 		return
@@ -610,9 +843,19 @@ func addToCartHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	conflict, err := cartConflict(tx, userID, req.ItemID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if conflict {
+		http.Error(w, "Your cart already holds this item as part of a bundle, or an item of this bundle", http.StatusBadRequest)
+		return
+	}
+
 	_, err = tx.Exec(`
-      INSERT INTO cart_items (user_id, item_id)
-      VALUES ($1, $2)`,
+      INSERT INTO cart_items (user_id, item_id, price_at_add)
+      SELECT $1, id, price FROM items WHERE id = $2`,
 		userID, req.ItemID)
 
 	if err != nil {
@@ -628,20 +871,31 @@ func addToCartHandler(w http.ResponseWriter, r *http.Request) {
 	viewCartHandler(w, r)
 }
 
+// viewCartHandler lists the cart with each line flagged if the item was
+// removed, sold or repriced since it was added. Lines stay in the cart
+// until the buyer removes them, so nothing disappears without notice.
 func viewCartHandler(w http.ResponseWriter, r *http.Request) {
 	userID, _ := getUserIDFromContext(r.Context())
 
+	if err := touchCart(db, userID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
 	rows, err := db.Query(`
-		SELECT i.id, i.title, i.description, i.price, i.size,
+		SELECT i.id, i.title, i.description, `+cartLinePriceSQL+`, `+multibuyPercentSQL+`, i.size,
 			   i.category, i.status, i.quantity, i.seller_id,
 			   u.name as seller_name, i.created_at,
-			   array_agg(im.image_path) as images
+			   `+itemImagesSQL+`,
+			   COALESCE(o.id::text, ''), c.price_at_add, `+cartLineStatusSQL+`
 		FROM cart_items c
 		JOIN items i ON c.item_id = i.id
 		LEFT JOIN item_images im ON i.id = im.item_id
 		JOIN users u ON i.seller_id = u.id
+		LEFT JOIN offers o ON o.item_id = i.id AND o.buyer_id = c.user_id
+			AND o.status = 'accepted' AND o.expires_at > CURRENT_TIMESTAMP
 		WHERE c.user_id = $1
-		GROUP BY i.id, u.name`,
+		GROUP BY i.id, u.name, c.id, o.id`,
 		userID)
 
 	if err != nil {
@@ -653,23 +907,19 @@ func viewCartHandler(w http.ResponseWriter, r *http.Request) {
 	var items []Item
 	for rows.Next() {
 		var item Item
-		var images []sql.NullString
+		var images, imageIDs []sql.NullString
 		err := rows.Scan(
-			&item.ID, &item.Title, &item.Description, &item.Price,
+			&item.ID, &item.Title, &item.Description, &item.Price, &item.DiscountPercent,
 			&item.Size, &item.Category, &item.Status, &item.Quantity,
-			&item.SellerID, &item.SellerName, &item.CreatedAt, pq.Array(&images))
+			&item.SellerID, &item.SellerName, &item.CreatedAt, pq.Array(&images), pq.Array(&imageIDs), &item.OfferID,
+			&item.PriceAtAdd, &item.CartStatus)
 
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 
-		item.Images = make([]string, 0)
-		for _, img := range images {
-			if img.Valid {
-				item.Images = append(item.Images, img.String)
-			}
-		}
+		setItemImages(&item, images, imageIDs)
 
 		items = append(items, item)
 	}
@@ -958,25 +1208,48 @@ func markMessagesAsSeenHandler(w http.ResponseWriter, r *http.Request) {
 func getUnreadNotificationsHandler(w http.ResponseWriter, r *http.Request) {
 	userID, _ := getUserIDFromContext(r.Context())
 
-	rows, err := db.Query(`
-			SELECT id, type, reference_id, message, created_at
-			FROM notifications
-			WHERE user_id = $1 AND read = false
-			ORDER BY created_at DESC`,
+	keys := newestFirstKeys("n")
+	page, err := parsePageRequest(r, "notifications", keys)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	total, err := page.countTotal(`
+			SELECT COUNT(*) FROM notifications n
+			WHERE n.user_id = $1 AND n.read = false`,
 		userID)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+
+	args := []interface{}{userID}
+	filter := ""
+	if cond, pageArgs := page.where(keys, 2); cond != "" {
+		filter = " AND " + cond
+		args = append(args, pageArgs...)
+	}
+
+	rows, err := db.Query(`
+			SELECT n.id, n.type, n.reference_id, n.message, n.created_at
+			FROM notifications n
+			WHERE n.user_id = $1 AND n.read = false`+filter+`
+			ORDER BY `+orderByKeys(keys)+page.limitClause(),
+		args...)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 	defer rows.Close()
 
-	var notifications []struct {
+	notifications := make([]struct {
 		ID          string    `json:"id"`
 		Type        string    `json:"type"`
 		ReferenceID string    `json:"reference_id"`
 		Message     string    `json:"message"`
 		CreatedAt   time.Time `json:"created_at"`
-	}
+	}, 0)
 
 	for rows.Next() {
 		var n struct {
@@ -993,7 +1266,15 @@ func getUnreadNotificationsHandler(w http.ResponseWriter, r *http.Request) {
 		notifications = append(notifications, n)
 	}
 
-	sendJSON(w, notifications)
+	result := Page{Total: total}
+	if page.hasMore(len(notifications)) {
+		notifications = notifications[:page.limit]
+		last := notifications[len(notifications)-1]
+		result.NextCursor = page.nextCursor(keys, createdAtCursorValues(last.CreatedAt, last.ID))
+	}
+	result.Items = notifications
+
+	sendJSON(w, result)
 }
 
 func markNotificationAsSeenHandler(w http.ResponseWriter, r *http.Request) {
@@ -1075,9 +1356,62 @@ func checkoutHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	defer tx.Rollback()
 
+	if err := lockCartItems(tx, userID); err != nil {
+		log.Printf("Error locking cart items: %v", err)
+		http.Error(w, "Failed to check cart", http.StatusInternalServerError)
+		return
+	}
+
+	var cartItemIDs []string
+	err = tx.QueryRow(`
+			SELECT COALESCE(array_agg(item_id::text), '{}') FROM cart_items WHERE user_id = $1`,
+		userID).Scan(pq.Array(&cartItemIDs))
+	if err != nil {
+		log.Printf("Error checking cart: %v", err)
+		http.Error(w, "Failed to check cart", http.StatusInternalServerError)
+		return
+	}
+	auctioned, err := anyInOpenAuction(tx, cartItemIDs)
+	if err != nil {
+		log.Printf("Error checking cart: %v", err)
+		http.Error(w, "Failed to check cart", http.StatusInternalServerError)
+		return
+	}
+	if auctioned {
+		http.Error(w, "Some items in your cart are being auctioned, please review your cart", http.StatusConflict)
+		return
+	}
+
+	var unavailable, repriced int
+	err = tx.QueryRow(`
+			SELECT COUNT(*) FILTER (WHERE status IN ('removed', 'sold')),
+				   COUNT(*) FILTER (WHERE status = 'price_changed')
+			FROM (
+				SELECT `+cartLineStatusSQL+` AS status
+				FROM cart_items c
+				JOIN items i ON c.item_id = i.id
+				WHERE c.user_id = $1
+			) lines`,
+		userID).Scan(&unavailable, &repriced)
+	if err != nil {
+		log.Printf("Error checking cart: %v", err)
+		http.Error(w, "Failed to check cart", http.StatusInternalServerError)
+		return
+	}
+	if unavailable > 0 {
+		http.Error(w, "Some items in your cart are no longer available, please review your cart", http.StatusConflict)
+		return
+	}
+	if repriced > 0 {
+		http.Error(w, "Some prices in your cart have changed, please review and accept them", http.StatusConflict)
+		return
+	}
+
+	// Items with an accepted offer are charged at the agreed price, less
+	// any multi-buy discount
 	var total float64
 	err = tx.QueryRow(`
-			SELECT COALESCE(SUM(i.price), 0)
+			SELECT COALESCE(SUM(`+cartLinePriceSQL+`), 0)
 			FROM cart_items c
 			JOIN items i ON c.item_id = i.id
 			WHERE c.user_id = $1`,
@@ -1137,7 +1471,7 @@ func checkoutHandler(w http.ResponseWriter, r *http.Request) {
 
 	_, err = tx.Exec(`
 			INSERT INTO order_items (order_id, item_id, price_at_time)
-			SELECT $1, i.id, i.price
+			SELECT $1, i.id, `+cartLinePriceSQL+`
 			FROM cart_items c
 			JOIN items i ON c.item_id = i.id
 			WHERE c.user_id = $2`,
@@ -1164,6 +1498,18 @@ func checkoutHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if err := sellBundleStock(tx, orderID); err != nil {
+		log.Printf("Error updating bundle inventory: %v", err)
+		http.Error(w, "Failed to update inventory", http.StatusInternalServerError)
+		return
+	}
+
+	if err := completeOffers(tx, userID, orderID); err != nil {
+		log.Printf("Error completing offers: %v", err)
+		http.Error(w, "Failed to apply offers", http.StatusInternalServerError)
+		return
+	}
+
 	if err := notifySellers(tx, userID, orderID); err != nil {
 		log.Printf("Error notifying sellers: %v", err)
 	}
@@ -1229,6 +1575,32 @@ func getUserOrdersHandler(w http.ResponseWriter, r *http.Request) {
 
 	userID, _ := getUserIDFromContext(r.Context())
 
+	keys := newestFirstKeys("o")
+	page, err := parsePageRequest(r, "user-orders", keys)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	total, err := page.countTotal(`
+			SELECT COUNT(DISTINCT o.id)
+			FROM orders o
+			LEFT JOIN order_items oi ON o.id = oi.order_id
+			LEFT JOIN items i ON oi.item_id = i.id
+			WHERE o.user_id = $1 OR i.seller_id = $1`,
+		userID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	args := []interface{}{userID}
+	filter := ""
+	if cond, pageArgs := page.where(keys, 2); cond != "" {
+		filter = " AND " + cond
+		args = append(args, pageArgs...)
+	}
+
 	rows, err := db.Query(`
 			SELECT
 					o.id,
@@ -1236,6 +1608,7 @@ func getUserOrdersHandler(w http.ResponseWriter, r *http.Request) {
 					o.status,
 					o.created_at,
 					o.updated_at,
+					COALESCE(o.trade_id::text, ''),
 					a.id as address_id,
 					a.first_name,
 					a.last_name,
@@ -1261,11 +1634,11 @@ func getUserOrdersHandler(w http.ResponseWriter, r *http.Request) {
 			LEFT JOIN order_items oi ON o.id = oi.order_id
 			LEFT JOIN items i ON oi.item_id = i.id
 			LEFT JOIN users u ON i.seller_id = u.id
-			WHERE o.user_id = $1 OR i.seller_id = $1
+			WHERE (o.user_id = $1 OR i.seller_id = $1)`+filter+`
 			GROUP BY o.id, o.user_id, a.id, a.first_name, a.last_name, a.street, a.city,
 							 a.state, a.zip_code, a.country
-			ORDER BY o.created_at DESC`,
-		userID)
+			ORDER BY `+orderByKeys(keys)+page.limitClause(),
+		args...)
 
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -1290,11 +1663,12 @@ func getUserOrdersHandler(w http.ResponseWriter, r *http.Request) {
 		Status    string       `json:"status"`
 		CreatedAt time.Time    `json:"created_at"`
 		UpdatedAt time.Time    `json:"updated_at"`
+		TradeID   string       `json:"trade_id,omitempty"`
 		Address   OrderAddress `json:"address"`
 		Items     []OrderItem  `json:"items"`
 	}
 
-	var orders []Order
+	orders := make([]Order, 0)
 	for rows.Next() {
 		var o Order
 		var addr OrderAddress
@@ -1306,6 +1680,7 @@ func getUserOrdersHandler(w http.ResponseWriter, r *http.Request) {
 			&o.Status,
 			&o.CreatedAt,
 			&o.UpdatedAt,
+			&o.TradeID,
 			&addr.ID,
 			&addr.FirstName,
 			&addr.LastName,
@@ -1336,7 +1711,15 @@ func getUserOrdersHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	sendJSON(w, orders)
+	result := Page{Total: total}
+	if page.hasMore(len(orders)) {
+		orders = orders[:page.limit]
+		last := orders[len(orders)-1]
+		result.NextCursor = page.nextCursor(keys, createdAtCursorValues(last.CreatedAt, last.ID))
+	}
+	result.Items = orders
+
+	sendJSON(w, result)
 }
 
 func updateOrderStatusHandler(w http.ResponseWriter, r *http.Request) {
@@ -1364,13 +1747,47 @@ func updateOrderStatusHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	defer tx.Rollback()
 
-	var buyerID string
-	err = tx.QueryRow(`SELECT user_id FROM orders WHERE id = $1`, orderID).Scan(&buyerID)
+	// The two orders of a swap change together, so both are locked, in id
+	// order so two cancellations of the same swap cannot deadlock
+	_, err = tx.Exec(`
+			SELECT id FROM orders
+			WHERE id = $1 OR trade_id = (SELECT trade_id FROM orders WHERE id = $1)
+			ORDER BY id
+			FOR UPDATE`,
+		orderID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Only the buyer and the sellers of an order may change its status
+	var buyerID, currentStatus string
+	var restocked, isSeller bool
+	var tradeID sql.NullString
+	err = tx.QueryRow(`
+			SELECT o.user_id, o.status, o.restocked, o.trade_id,
+				   EXISTS (
+						SELECT 1 FROM order_items oi
+						JOIN items i ON oi.item_id = i.id
+						WHERE oi.order_id = o.id AND i.seller_id = $2)
+			FROM orders o
+			WHERE o.id = $1`,
+		orderID, userID).Scan(&buyerID, &currentStatus, &restocked, &tradeID, &isSeller)
+	if err == sql.ErrNoRows || (err == nil && buyerID != userID && !isSeller) {
+		http.Error(w, "Order not found or not authorized", http.StatusNotFound)
+		return
+	}
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
+	// A cancelled order has given its items back, so it cannot be revived
+	if currentStatus == "cancelled" {
+		http.Error(w, "Order has been cancelled", http.StatusBadRequest)
+		return
+	}
+
 	// Update order status
 	_, err = tx.Exec(`
 			UPDATE orders
@@ -1382,6 +1799,23 @@ func updateOrderStatusHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if req.Status == "cancelled" && !restocked {
+		if err := restockCancelledOrder(tx, orderID); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if req.Status == "cancelled" && tradeID.Valid {
+		if userErr, err := cancelTradePartnerOrder(tx, tradeID.String, orderID, req.Message); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		} else if userErr != "" {
+			http.Error(w, userErr, http.StatusBadRequest)
+			return
+		}
+	}
+
 	// Create notification for status change
 	var notificationMsg string
 	switch req.Status {
@@ -1426,6 +1860,58 @@ func updateOrderStatusHandler(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// restockCancelledOrder puts the items of a cancelled order back on sale
+// and tells anyone who favorited a sold out item that it is available again.
+// The order is marked restocked so its items are only ever returned once.
+// Deleted items get their stock back but stay off sale.
+func restockCancelledOrder(tx *sql.Tx, orderID string) error {
+	_, err := tx.Exec(`UPDATE orders SET restocked = true WHERE id = $1`, orderID)
+	if err != nil {
+		return err
+	}
+
+	rows, err := tx.Query(`
+			UPDATE items i
+			SET quantity = i.quantity + (
+					SELECT COUNT(*) FROM order_items oi
+					WHERE oi.item_id = i.id AND oi.order_id = $1),
+				status = CASE
+						WHEN i.status = 'sold' AND i.deleted_at IS NULL THEN 'available'::item_status_enum
+						ELSE i.status
+				END
+			FROM items prev
+			WHERE prev.id = i.id
+			AND i.id IN (SELECT item_id FROM order_items WHERE order_id = $1)
+			RETURNING i.id, prev.status`,
+		orderID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var restocked []string
+	for rows.Next() {
+		var itemID, previousStatus string
+		if err := rows.Scan(&itemID, &previousStatus); err != nil {
+			return err
+		}
+		if previousStatus == "sold" {
+			restocked = append(restocked, itemID)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	bundleRestocked, err := restockBundles(tx, orderID)
+	if err != nil {
+		return err
+	}
+
+	return notifyFavoritesBackInStock(tx, append(restocked, bundleRestocked...))
+}
+
 func getMessageHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -1435,22 +1921,42 @@ func getMessageHandler(w http.ResponseWriter, r *http.Request) {
 	orderID := strings.TrimPrefix(r.URL.Path, "/orders/")
 	orderID = strings.TrimSuffix(orderID, "/messages")
 
+	keys := oldestFirstKeys("m")
+	page, err := parsePageRequest(r, "messages:"+orderID, keys)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	total, err := page.countTotal(`SELECT COUNT(*) FROM messages m WHERE m.order_id = $1`, orderID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	args := []interface{}{orderID}
+	filter := ""
+	if cond, pageArgs := page.where(keys, 2); cond != "" {
+		filter = " AND " + cond
+		args = append(args, pageArgs...)
+	}
+
 	rows, err := db.Query(`
-      SELECT id, sender_id, message, created_at
-      FROM messages
-      WHERE order_id = $1
-      ORDER BY created_at ASC`,
-		orderID)
+      SELECT m.id, m.sender_id, m.message, m.is_auto_reply, m.created_at
+      FROM messages m
+      WHERE m.order_id = $1`+filter+`
+      ORDER BY `+orderByKeys(keys)+page.limitClause(),
+		args...)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 	defer rows.Close()
 
-	var messages []Message
+	messages := make([]Message, 0)
 	for rows.Next() {
 		var msg Message
-		err := rows.Scan(&msg.ID, &msg.SenderID, &msg.Message, &msg.CreatedAt)
+		err := rows.Scan(&msg.ID, &msg.SenderID, &msg.Message, &msg.IsAutoReply, &msg.CreatedAt)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
@@ -1458,7 +1964,15 @@ func getMessageHandler(w http.ResponseWriter, r *http.Request) {
 		messages = append(messages, msg)
 	}
 
-	sendJSON(w, messages)
+	result := Page{Total: total}
+	if page.hasMore(len(messages)) {
+		messages = messages[:page.limit]
+		last := messages[len(messages)-1]
+		result.NextCursor = page.nextCursor(keys, createdAtCursorValues(last.CreatedAt, last.ID))
+	}
+	result.Items = messages
+
+	sendJSON(w, result)
 }
 
 func sendMessageHandler(w http.ResponseWriter, r *http.Request) {
@@ -1488,6 +2002,10 @@ func sendMessageHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if err := sendVacationAutoReplies(orderID, userID); err != nil {
+		log.Printf("Error sending vacation auto-replies: %v", err)
+	}
+
 	w.WriteHeader(http.StatusCreated)
 }
 
@@ -1506,6 +2024,36 @@ func enableCors(h http.HandlerFunc) http.HandlerFunc {
 	}
 }
 
+// userIDFromToken returns the user of a valid bearer token, for handlers
+// that also serve anonymous requests
+func userIDFromToken(r *http.Request) (string, bool) {
+	tokenString := r.Header.Get("Authorization")
+	if tokenString == "" {
+		return "", false
+	}
+
+	tokenString = strings.Replace(tokenString, "Bearer ", "", 1)
+
+	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected signing method")
+		}
+		return []byte("your-secret-key"), nil
+	})
+
+	if err != nil || !token.Valid {
+		return "", false
+	}
+
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return "", false
+	}
+
+	userID, ok := claims["user_id"].(string)
+	return userID, ok
+}
+
 func authMiddleware(h http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "http://localhost:5173")
@@ -1517,41 +2065,31 @@ func authMiddleware(h http.HandlerFunc) http.HandlerFunc {
 			return
 		}
 
-		tokenString := r.Header.Get("Authorization")
-		if tokenString == "" {
+		userID, ok := userIDFromToken(r)
+		if !ok {
 			http.Error(w, "Unauthorized", http.StatusUnauthorized)
 			return
 		}
 
-		tokenString = strings.Replace(tokenString, "Bearer ", "", 1)
-
-		token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-				return nil, fmt.Errorf("unexpected signing method")
-			}
-			return []byte("your-secret-key"), nil
-		})
-
-		if err != nil || !token.Valid {
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
-			return
-		}
+		r = r.WithContext(context.WithValue(r.Context(), "userID", userID))
+		h(w, r)
+	}
+}
 
-		claims, ok := token.Claims.(jwt.MapClaims)
-		if !ok {
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
-			return
-		}
+// adminMiddleware restricts a handler to authenticated administrators
+func adminMiddleware(h http.HandlerFunc) http.HandlerFunc {
+	return authMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		userID, _ := getUserIDFromContext(r.Context())
 
-		userID, ok := claims["user_id"].(string)
-		if !ok {
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		var isAdmin bool
+		err := db.QueryRow(`SELECT is_admin FROM users WHERE id = $1`, userID).Scan(&isAdmin)
+		if err != nil || !isAdmin {
+			http.Error(w, "Forbidden", http.StatusForbidden)
 			return
 		}
 
-		r = r.WithContext(context.WithValue(r.Context(), "userID", userID))
 		h(w, r)
-	}
+	})
 }
 
 func getUserIDFromContext(ctx context.Context) (string, bool) {
@@ -1570,14 +2108,43 @@ func getUserItemsHandler(w http.ResponseWriter, r *http.Request) {
 
 	userID, _ := getUserIDFromContext(r.Context())
 
+	keys := newestFirstKeys("i")
+	page, err := parsePageRequest(r, "user-items", keys)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// With ?deleted=true the seller sees items that can still be restored
+	args := []interface{}{userID}
+	filter := "AND i.deleted_at IS NULL"
+	if r.URL.Query().Get("deleted") == "true" {
+		filter = "AND i.deleted_at > $2"
+		args = append(args, time.Now().Add(-itemRestoreGracePeriod))
+	}
+
+	total, err := page.countTotal(`SELECT COUNT(*) FROM items i WHERE i.seller_id = $1 `+filter, args...)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if cond, pageArgs := page.where(keys, len(args)+1); cond != "" {
+		filter += " AND " + cond
+		args = append(args, pageArgs...)
+	}
+
 	rows, err := db.Query(`
 			SELECT
 					i.id,
 					i.title,
 					i.description,
+					COALESCE(i.brand, ''),
 					i.price,
 					i.size,
 					i.category,
+					COALESCE(i.condition::text, ''),
+					i.local_pickup,
 					get_actual_item_status(i.id) as status,
 					CASE
 							WHEN get_actual_item_status(i.id) IN ('reserved', 'delivered', 'cancelled') THEN 0
@@ -1585,8 +2152,11 @@ func getUserItemsHandler(w http.ResponseWriter, r *http.Request) {
 					END as display_quantity,
 					i.seller_id,
 					u.name as seller_name,
+					i.publish_at,
+					i.deleted_at,
 					i.created_at,
-					array_agg(COALESCE(im.image_path, '')) as images,
+					`+favoritesCountSQL+`,
+					`+itemImagesSQL+`,
 					EXISTS (
 							SELECT 1 FROM order_items oi
 							JOIN orders o ON oi.order_id = o.id
@@ -1596,10 +2166,10 @@ func getUserItemsHandler(w http.ResponseWriter, r *http.Request) {
 			FROM items i
 			LEFT JOIN item_images im ON i.id = im.item_id
 			JOIN users u ON i.seller_id = u.id
-			WHERE i.seller_id = $1
+			WHERE i.seller_id = $1 `+filter+`
 			GROUP BY i.id, u.name
-			ORDER BY i.created_at DESC`,
-		userID)
+			ORDER BY `+orderByKeys(keys)+page.limitClause(),
+		args...)
 
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -1607,25 +2177,32 @@ func getUserItemsHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	defer rows.Close()
 
-	var items []Item
+	items := make([]Item, 0)
 	for rows.Next() {
 		var item Item
-		var images []sql.NullString
+		var images, imageIDs []sql.NullString
 		var hasActiveOrder bool
 
 		err := rows.Scan(
 			&item.ID,
 			&item.Title,
 			&item.Description,
+			&item.Brand,
 			&item.Price,
 			&item.Size,
 			&item.Category,
+			&item.Condition,
+			&item.LocalPickup,
 			&item.Status,
 			&item.Quantity,
 			&item.SellerID,
 			&item.SellerName,
+			&item.PublishAt,
+			&item.DeletedAt,
 			&item.CreatedAt,
+			&item.FavoritesCount,
 			pq.Array(&images),
+			pq.Array(&imageIDs),
 			&hasActiveOrder,
 		)
 
@@ -1634,17 +2211,20 @@ func getUserItemsHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		item.Images = make([]string, 0)
-		for _, img := range images {
-			if img.Valid && img.String != "" {
-				item.Images = append(item.Images, img.String)
-			}
-		}
+		setItemImages(&item, images, imageIDs)
 
 		items = append(items, item)
 	}
 
-	sendJSON(w, items)
+	result := Page{Total: total}
+	if page.hasMore(len(items)) {
+		items = items[:page.limit]
+		last := items[len(items)-1]
+		result.NextCursor = page.nextCursor(keys, createdAtCursorValues(last.CreatedAt, last.ID))
+	}
+	result.Items = items
+
+	sendJSON(w, result)
 }
 
 func deleteItemHandler(w http.ResponseWriter, r *http.Request) {
@@ -1663,128 +2243,266 @@ func deleteItemHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	defer tx.Rollback()
 
-	// First verify the item exists and belongs to the user
-	var exists bool
-	err = tx.QueryRow(`
-			SELECT EXISTS (
-					SELECT 1 FROM items
-					WHERE id = $1 AND seller_id = $2
-			)`, itemID, userID).Scan(&exists)
-
+	// Locks the item so a bid cannot slip in before it is deleted
+	_, err = tx.Exec(`SELECT 1 FROM items WHERE id = $1 AND seller_id = $2 FOR UPDATE`, itemID, userID)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	if !exists {
-		http.Error(w, "Item not found or not authorized", http.StatusNotFound)
+	bidOn, err := hasLiveBids(tx, itemID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if bidOn {
+		http.Error(w, "This item has bids in an open auction and cannot be deleted", http.StatusBadRequest)
 		return
 	}
 
-	// Delete related cart items
-	_, err = tx.Exec(`DELETE FROM cart_items WHERE item_id = $1`, itemID)
+	// Items are only marked as deleted so they can be restored and so orders
+	// keep referring to them. Images are removed later by the purge job.
+	result, err := tx.Exec(`
+			UPDATE items
+			SET deleted_at = CURRENT_TIMESTAMP
+			WHERE id = $1 AND seller_id = $2 AND deleted_at IS NULL`,
+		itemID, userID)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	// Delete from images first
-	rows, err := tx.Query("SELECT image_path FROM item_images WHERE item_id = $1", itemID)
+	rowsAffected, err := result.RowsAffected()
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	defer rows.Close()
 
-	var imagePaths []string
-	for rows.Next() {
-		var path string
-		if err := rows.Scan(&path); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		imagePaths = append(imagePaths, path)
+	if rowsAffected == 0 {
+		http.Error(w, "Item not found or not authorized", http.StatusNotFound)
+		return
 	}
 
-	// Delete the item images
-	_, err = tx.Exec("DELETE FROM item_images WHERE item_id = $1", itemID)
-	if err != nil {
+	if err = tx.Commit(); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	// Delete the item
-	result, err := tx.Exec("DELETE FROM items WHERE id = $1 AND seller_id = $2", itemID, userID)
-	if err != nil {
-		if pqErr, ok := err.(*pq.Error); ok {
-			if pqErr.Code == "23503" { // Foreign key violation
-				http.Error(w, "Cannot delete item: it is part of existing orders", http.StatusBadRequest)
-				return
-			}
+	sendJSON(w, map[string]interface{}{
+		"id":            itemID,
+		"restore_until": time.Now().Add(itemRestoreGracePeriod),
+	})
+}
+
+// imageVisibleSQL restricts images to those of items i that buyers can see,
+// sold ones included so past orders keep their photos, unless the user in
+// $2 is the seller. Drafts, paused, held and deleted listings stay private.
+const imageVisibleSQL = `(i.seller_id::text = $2 OR (i.deleted_at IS NULL
+			AND i.status NOT IN ('draft', 'scheduled', 'paused') AND NOT i.moderation_hold))`
+
+// serveImageHandler serves /images/{image_id}. The legacy form
+// /images?path=... is still accepted but, like every image route, only
+// serves files that belong to a known item_images row.
+func serveImageHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, _ := userIDFromToken(r)
+
+	var imageID, imagePath string
+	var err error
+	if id := strings.TrimPrefix(r.URL.Path, "/images/"); id != "" && id != r.URL.Path {
+		if _, parseErr := uuid.Parse(id); parseErr != nil {
+			http.Error(w, "Image not found", http.StatusNotFound)
+			return
 		}
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		imageID = id
+		err = db.QueryRow(`
+			SELECT im.image_path FROM item_images im
+			JOIN items i ON im.item_id = i.id
+			WHERE im.id = $1 AND `+imageVisibleSQL,
+			imageID, userID).Scan(&imagePath)
+	} else if path := r.URL.Query().Get("path"); path != "" {
+		err = db.QueryRow(`
+			SELECT im.id, im.image_path FROM item_images im
+			JOIN items i ON im.item_id = i.id
+			WHERE im.image_path = $1 AND `+imageVisibleSQL+`
+			LIMIT 1`,
+			path, userID).Scan(&imageID, &imagePath)
+	} else {
+		http.Error(w, "Image ID is required", http.StatusBadRequest)
 		return
 	}
 
-	rowsAffected, err := result.RowsAffected()
+	if err == sql.ErrNoRows {
+		http.Error(w, "Image not found", http.StatusNotFound)
+		return
+	}
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	if rowsAffected == 0 {
-		http.Error(w, "Item not found or not authorized", http.StatusNotFound)
+	serveStoredImage(w, r, imageID, imagePath)
+}
+
+// serveItemImageHandler serves /items/{id}/images/{n}, the n-th image of an
+// item counting from zero in upload order.
+func serveItemImageHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	// Delete physical image files
-	for _, path := range imagePaths {
-		os.Remove(filepath.Join(".", path))
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/items/"), "/")
+	if len(parts) != 3 || parts[1] != "images" {
+		http.NotFound(w, r)
+		return
 	}
 
-	if err = tx.Commit(); err != nil {
+	itemID := parts[0]
+	n, err := strconv.Atoi(parts[2])
+	if _, parseErr := uuid.Parse(itemID); parseErr != nil || err != nil || n < 0 {
+		http.Error(w, "Image not found", http.StatusNotFound)
+		return
+	}
+
+	userID, _ := userIDFromToken(r)
+
+	var imageID, imagePath string
+	err = db.QueryRow(`
+		SELECT im.id, im.image_path FROM item_images im
+		JOIN items i ON im.item_id = i.id
+		WHERE im.item_id = $1 AND `+imageVisibleSQL+`
+		ORDER BY im.created_at, im.id
+		OFFSET $3 LIMIT 1`,
+		itemID, userID, n).Scan(&imageID, &imagePath)
+
+	if err == sql.ErrNoRows {
+		http.Error(w, "Image not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	w.WriteHeader(http.StatusOK)
+	serveStoredImage(w, r, imageID, imagePath)
 }
-func serveImageHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
+
+// serveStoredImage sends a known image, or one of its thumbnails when the
+// size query parameter asks for one. Images uploaded before thumbnails were
+// introduced only have the original.
+func serveStoredImage(w http.ResponseWriter, r *http.Request, imageID, imagePath string) {
+	variant := r.URL.Query().Get("size")
+	if variant == "" {
+		variant = "large"
+	}
+
+	if variant != "large" {
+		if _, ok := imageVariants[variant]; !ok {
+			http.Error(w, "Invalid image size", http.StatusBadRequest)
+			return
+		}
+		variantPath := imageVariantPath(imagePath, variant)
+		if _, err := blobs.Stat(variantPath); err == nil {
+			imagePath = variantPath
+		} else {
+			variant = "large"
+		}
 	}
 
-	imagePath := r.URL.Query().Get("path")
-	if imagePath == "" {
-		http.Error(w, "Image path is required", http.StatusBadRequest)
+	// Stored images never change, so the row ID identifies the content
+	etag := fmt.Sprintf(`"%s-%s"`, imageID, variant)
+	serveImageBlob(w, r, imagePath, etag)
+}
+
+// serveImageBlob sends a stored image, redirecting to a signed URL when the
+// blob store can provide one. Conditional and range requests are handled
+// for blobs that can seek.
+func serveImageBlob(w http.ResponseWriter, r *http.Request, imagePath, etag string) {
+	info, err := blobs.Stat(imagePath)
+	if err == errBlobNotFound {
+		http.Error(w, "Image not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	// Convert relative path to absolute path
-	fullPath := filepath.Join(".", imagePath)
+	if signedURL, err := blobs.SignedURL(imagePath, signedImageURLExpiry); err == nil {
+		w.Header().Set("Cache-Control", fmt.Sprintf("private, max-age=%d", int(signedImageURLExpiry.Seconds()/2)))
+		http.Redirect(w, r, signedURL, http.StatusFound)
+		return
+	} else if err != errSignedURLUnsupported {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 
-	// Basic security check to prevent directory traversal
-	if !strings.Contains(fullPath, uploadDir) && !strings.Contains(fullPath, "uploads") {
-		http.Error(w, "Invalid image path", http.StatusBadRequest)
+	blob, err := blobs.Open(imagePath)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	defer blob.Close()
 
-	// Check if file exists
-	if _, err := os.Stat(fullPath); os.IsNotExist(err) {
+	contentType, content, err := sniffContentType(blob)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !allowedImageTypes[contentType] {
 		http.Error(w, "Image not found", http.StatusNotFound)
 		return
 	}
 
 	// Set appropriate headers
-	w.Header().Set("Content-Type", "image/jpeg") // You might want to detect the actual content type
-	w.Header().Set("Cache-Control", "public, max-age=31536000")
+	w.Header().Set("Content-Type", contentType)
+	// Sellers may fetch photos of their unpublished listings, which shared
+	// caches must not keep
+	if r.Header.Get("Authorization") != "" {
+		w.Header().Set("Cache-Control", "private, max-age=31536000, immutable")
+	} else {
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	}
+	w.Header().Set("ETag", etag)
 
-	http.ServeFile(w, r, fullPath)
+	if seeker, ok := blob.(io.ReadSeeker); ok {
+		seeker.Seek(0, io.SeekStart)
+		http.ServeContent(w, r, imagePath, info.ModTime, seeker)
+		return
+	}
+
+	w.Header().Set("Last-Modified", info.ModTime.UTC().Format(http.TimeFormat))
+	w.Header().Set("Content-Length", fmt.Sprint(info.Size))
+	io.Copy(w, content)
 }
 
 func main() {
 	initDB()
+	initBlobStore()
+	initMailer()
+	initCartExpiry()
+	loadPostcodes()
+
+	if err := searchSynonyms.load(); err != nil {
+		log.Printf("Error loading search synonyms: %v", err)
+	}
+
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "migrate-images":
+			runMigrateImages(os.Args[2:])
+		case "gc-images":
+			runImageGC(os.Args[2:])
+		default:
+			log.Fatalf("Unknown command: %s", os.Args[1])
+		}
+		return
+	}
 
 	mux := http.NewServeMux()
 
@@ -1801,13 +2519,33 @@ func main() {
 	mux.HandleFunc("/user/orders", authMiddleware(getUserOrdersHandler))
 	mux.HandleFunc("/items/create", authMiddleware(createItemWithImagesHandler))
 	mux.HandleFunc("/items/delete", authMiddleware(deleteItemHandler))
+	mux.HandleFunc("/items/restore", authMiddleware(restoreItemHandler))
+	mux.HandleFunc("/items/status", authMiddleware(updateItemStatusHandler))
+	mux.HandleFunc("/items/price", authMiddleware(updateItemPriceHandler))
+	mux.HandleFunc("/items/pickup", authMiddleware(updateItemPickupHandler))
+	mux.HandleFunc("/items/images/add", authMiddleware(addItemImagesHandler))
+	mux.HandleFunc("/items/import", authMiddleware(importItemsHandler))
+	mux.HandleFunc("/user/items/export", authMiddleware(exportItemsHandler))
+	mux.HandleFunc("/user/items/export/images", authMiddleware(exportItemImagesHandler))
 	mux.HandleFunc("/orders/update", authMiddleware(updateOrderStatusHandler))
 	mux.HandleFunc("/orders/archive", authMiddleware(archiveOrderHandler))
 	mux.HandleFunc("/cart/add", authMiddleware(addToCartHandler))
 	mux.HandleFunc("/cart", authMiddleware(viewCartHandler))
 	mux.HandleFunc("/cart/remove", authMiddleware(removeFromCartHandler))
+	mux.HandleFunc("/cart/accept-price", authMiddleware(acceptCartPriceHandler))
 	mux.HandleFunc("/checkout", authMiddleware(checkoutHandler))
+	mux.HandleFunc("/offers", enableCors(authMiddleware(offersHandler)))
+	mux.HandleFunc("/offers/respond", enableCors(authMiddleware(respondToOfferHandler)))
+	mux.HandleFunc("/trades", enableCors(authMiddleware(tradesHandler)))
+	mux.HandleFunc("/trades/respond", enableCors(authMiddleware(respondToTradeHandler)))
+	mux.HandleFunc("/free-requests", enableCors(authMiddleware(freeRequestsHandler)))
+	mux.HandleFunc("/auctions/bid", enableCors(authMiddleware(placeBidHandler)))
 	mux.HandleFunc("/user/current", authMiddleware(getCurrentUserHandler))
+	mux.HandleFunc("/user/vacation", authMiddleware(vacationHandler))
+	mux.HandleFunc("/user/saved-searches", enableCors(authMiddleware(savedSearchesHandler)))
+	mux.HandleFunc("/user/pickup-location", enableCors(authMiddleware(pickupLocationHandler)))
+	mux.HandleFunc("/user/favorites", enableCors(authMiddleware(favoritesHandler)))
+	mux.HandleFunc("/user/multibuy-discount", enableCors(authMiddleware(multibuyDiscountHandler)))
 	mux.HandleFunc("/messages/seen", enableCors(authMiddleware(markMessagesAsSeenHandler)))
 	mux.HandleFunc("/orders/", enableCors(authMiddleware(func(w http.ResponseWriter, r *http.Request) {
 		if strings.HasSuffix(r.URL.Path, "/messages") {
@@ -1823,19 +2561,59 @@ func main() {
 			}
 		}
 	})))
+	mux.HandleFunc("/items/", enableCors(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/duplicate"):
+			authMiddleware(duplicateItemHandler)(w, r)
+		case strings.HasSuffix(r.URL.Path, "/price-history"):
+			itemPriceHistoryHandler(w, r)
+		case strings.HasSuffix(r.URL.Path, "/requests"):
+			authMiddleware(freeItemRequestsHandler)(w, r)
+		case strings.Contains(r.URL.Path, "/images/"):
+			serveItemImageHandler(w, r)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
 	// Update your endpoint handlers in main() function
 	mux.HandleFunc("/notifications/unread", enableCors(authMiddleware(getUnreadNotificationsHandler)))
 	mux.HandleFunc("/notifications/seen/", enableCors(authMiddleware(markNotificationAsSeenHandler)))
 	mux.HandleFunc("/notifications/clear", enableCors(authMiddleware(clearNotificationsHandler)))
 
+	// Admin routes
+	mux.HandleFunc("/admin/moderation", enableCors(adminMiddleware(getModerationQueueHandler)))
+	mux.HandleFunc("/admin/moderation/resolve", enableCors(adminMiddleware(resolveModerationFlagHandler)))
+	mux.HandleFunc("/admin/synonyms", enableCors(adminMiddleware(synonymsHandler)))
+
 	// Public routes
 	mux.HandleFunc("/items/search", enableCors(searchItemsHandler))
+	mux.HandleFunc("/items/suggest", enableCors(suggestHandler))
+	mux.HandleFunc("/auctions/bids", enableCors(auctionBidsHandler))
+	// Anyone can browse auctions, starting and cancelling one needs a login
+	mux.HandleFunc("/auctions", enableCors(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			auctionsHandler(w, r)
+			return
+		}
+		authMiddleware(auctionsHandler)(w, r)
+	}))
 	mux.HandleFunc("/images", enableCors(serveImageHandler))
+	mux.HandleFunc("/images/", enableCors(serveImageHandler))
 
 	if err := os.MkdirAll(uploadDir, 0755); err != nil {
 		log.Fatal("Error creating uploads directory:", err)
 	}
 
+	go startListingScheduler(time.Minute)
+	go startItemPurger(time.Hour)
+	go startImageReconciler(24 * time.Hour)
+	go startSavedSearchMatcher(time.Minute)
+	go startSearchDictionaryRefresher(10 * time.Minute)
+	go startSuggestionCache(5 * time.Minute)
+	go startOfferExpirer(time.Minute)
+	go startAuctionCloser(time.Minute)
+	go startCartPruner(time.Hour)
+
 	log.Println("Server starting on :8080")
 	log.Fatal(http.ListenAndServe(":8080", mux))
 }
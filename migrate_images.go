@@ -0,0 +1,115 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+)
+
+// runMigrateImages copies every image referenced by item_images, including
+// its thumbnails, from one blob store to another. Keys are unchanged so the
+// database needs no update; switch BLOB_STORE once the copy has finished.
+//
+//	go run . migrate-images -from local -to s3 [-delete-source] [-dry-run]
+func runMigrateImages(args []string) {
+	fs := flag.NewFlagSet("migrate-images", flag.ExitOnError)
+	from := fs.String("from", "local", "blob store to copy images from (local or s3)")
+	to := fs.String("to", "s3", "blob store to copy images to (local or s3)")
+	deleteSource := fs.Bool("delete-source", false, "delete each image from the source once copied")
+	dryRun := fs.Bool("dry-run", false, "only report what would be copied")
+	fs.Parse(args)
+
+	if *from == *to {
+		log.Fatal("-from and -to must name different blob stores")
+	}
+
+	src, err := newBlobStore(*from)
+	if err != nil {
+		log.Fatal(err)
+	}
+	dst, err := newBlobStore(*to)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	rows, err := db.Query(`SELECT DISTINCT image_path FROM item_images ORDER BY image_path`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var imagePaths []string
+	for rows.Next() {
+		var path string
+		if err := rows.Scan(&path); err != nil {
+			log.Fatal(err)
+		}
+		imagePaths = append(imagePaths, path)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		log.Fatal(err)
+	}
+
+	var copied, skipped, missing, failed int
+	for _, imagePath := range imagePaths {
+		for _, key := range imageFilePaths(imagePath) {
+			if _, err := dst.Stat(key); err == nil {
+				skipped++
+				if *deleteSource && !*dryRun {
+					if err := src.Delete(key); err != nil {
+						log.Printf("Error deleting %s from source: %v", key, err)
+					}
+				}
+				continue
+			}
+
+			if _, err := src.Stat(key); err == errBlobNotFound {
+				// Thumbnails are absent for images uploaded before they existed
+				if key == imagePath {
+					log.Printf("Missing in source: %s", key)
+					missing++
+				}
+				continue
+			}
+
+			if *dryRun {
+				log.Printf("Would copy %s", key)
+				copied++
+				continue
+			}
+
+			if err := migrateBlob(src, dst, key); err != nil {
+				log.Printf("Error copying %s: %v", key, err)
+				failed++
+				continue
+			}
+			copied++
+
+			if *deleteSource {
+				if err := src.Delete(key); err != nil {
+					log.Printf("Error deleting %s from source: %v", key, err)
+				}
+			}
+		}
+	}
+
+	log.Printf("Image migration from %s to %s: %d copied, %d already present, %d missing, %d failed",
+		*from, *to, copied, skipped, missing, failed)
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
+
+func migrateBlob(src, dst BlobStore, key string) error {
+	r, err := src.Open(key)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	contentType, content, err := sniffContentType(r)
+	if err != nil {
+		return err
+	}
+	return dst.Put(key, content, contentType)
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"image"
+	"net/http"
+	"time"
+
+	"github.com/lib/pq"
+	"golang.org/x/image/draw"
+)
+
+// Images whose hashes differ in at most this many of their 64 bits are
+// treated as the same photo, even after resizing or recompression.
+const duplicateImageMaxDistance = 6
+
+type ModerationFlag struct {
+	ID               string    `json:"id"`
+	ItemID           string    `json:"item_id"`
+	ItemTitle        string    `json:"item_title"`
+	SellerID         string    `json:"seller_id"`
+	ImageID          string    `json:"image_id"`
+	MatchedItemID    string    `json:"matched_item_id"`
+	MatchedItemTitle string    `json:"matched_item_title"`
+	MatchedSellerID  string    `json:"matched_seller_id"`
+	MatchedImageID   string    `json:"matched_image_id"`
+	Distance         int       `json:"distance"`
+	Status           string    `json:"status"`
+	CreatedAt        time.Time `json:"created_at"`
+}
+
+// perceptualHash computes a 64-bit difference hash: the image is shrunk to
+// 9x8 grayscale and each bit records whether a pixel is brighter than its
+// right-hand neighbour. Similar photos produce hashes that differ in few bits.
+func perceptualHash(img image.Image) int64 {
+	small := image.NewGray(image.Rect(0, 0, 9, 8))
+	draw.ApproxBiLinear.Scale(small, small.Bounds(), img, img.Bounds(), draw.Src, nil)
+
+	var hash uint64
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			hash <<= 1
+			if small.GrayAt(x, y).Y > small.GrayAt(x+1, y).Y {
+				hash |= 1
+			}
+		}
+	}
+	return int64(hash)
+}
+
+// flagDuplicateImages queues newly uploaded images for moderation when they
+// are near-duplicates of images already used by other sellers. Two hashes
+// within duplicateImageMaxDistance bits share at least one of their eight
+// 8-bit bands, so the index on phash_bands narrows the search to images
+// sharing a band before the exact distance is computed.
+func flagDuplicateImages(sellerID string, imageIDs []string) (int64, error) {
+	if len(imageIDs) == 0 {
+		return 0, nil
+	}
+	result, err := db.Exec(`
+		INSERT INTO image_moderation_flags (item_id, image_id, matched_item_id, matched_image_id, distance)
+		SELECT im.item_id, im.id, other.item_id, other.id,
+			   bit_count((im.phash # other.phash)::bit(64))
+		FROM item_images im
+		JOIN item_images other ON other.phash_bands && im.phash_bands AND other.item_id <> im.item_id
+		JOIN items i ON i.id = other.item_id
+		WHERE im.id = ANY($1)
+		AND im.phash IS NOT NULL
+		AND i.seller_id <> $2
+		AND bit_count((im.phash # other.phash)::bit(64)) <= $3
+		ON CONFLICT (image_id, matched_image_id) DO NOTHING`,
+		pq.Array(imageIDs), sellerID, duplicateImageMaxDistance)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func getModerationQueueHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	status := r.URL.Query().Get("status")
+	if status == "" {
+		status = "pending"
+	}
+
+	rows, err := db.Query(`
+		SELECT f.id, f.item_id, i.title, i.seller_id, f.image_id,
+			   f.matched_item_id, mi.title, mi.seller_id, f.matched_image_id,
+			   f.distance, f.status, f.created_at
+		FROM image_moderation_flags f
+		JOIN items i ON f.item_id = i.id
+		JOIN items mi ON f.matched_item_id = mi.id
+		WHERE f.status = $1
+		ORDER BY f.created_at ASC`,
+		status)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	flags := make([]ModerationFlag, 0)
+	for rows.Next() {
+		var f ModerationFlag
+		err := rows.Scan(&f.ID, &f.ItemID, &f.ItemTitle, &f.SellerID, &f.ImageID,
+			&f.MatchedItemID, &f.MatchedItemTitle, &f.MatchedSellerID, &f.MatchedImageID,
+			&f.Distance, &f.Status, &f.CreatedAt)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		flags = append(flags, f)
+	}
+
+	sendJSON(w, flags)
+}
+
+// resolveModerationFlagHandler dismisses a flag or confirms it. Confirming
+// pauses the flagged listing, holds it so the seller cannot publish it
+// again, and removes it from carts.
+func resolveModerationFlagHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, _ := getUserIDFromContext(r.Context())
+	flagID := r.URL.Query().Get("id")
+
+	var req struct {
+		Status string `json:"status"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Status != "dismissed" && req.Status != "confirmed" {
+		http.Error(w, "status must be dismissed or confirmed", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var itemID string
+	err = tx.QueryRow(`
+		UPDATE image_moderation_flags
+		SET status = $1, resolved_by = $2, resolved_at = CURRENT_TIMESTAMP
+		WHERE id = $3 AND status = 'pending'
+		RETURNING item_id`,
+		req.Status, userID, flagID).Scan(&itemID)
+
+	if err == sql.ErrNoRows {
+		http.Error(w, "Flag not found or already resolved", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if req.Status == "confirmed" {
+		_, err = tx.Exec(`
+			UPDATE items
+			SET moderation_hold = true,
+				status = CASE
+						WHEN status IN ('available', 'scheduled') THEN 'paused'::item_status_enum
+						ELSE status
+				END,
+				publish_at = CASE WHEN status = 'scheduled' THEN NULL ELSE publish_at END
+			WHERE id = $1`,
+			itemID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	sendJSON(w, map[string]string{
+		"status": "success",
+	})
+}
@@ -0,0 +1,474 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	// How long the other side has to answer an offer or counter offer
+	offerResponseWindow = 48 * time.Hour
+	// How long the buyer has to check out once an offer is accepted
+	offerCheckoutWindow = 48 * time.Hour
+)
+
+// cartPriceSQL is the price a buyer pays for item i in cart c: the amount
+// of their accepted offer if they have one, otherwise the listed price.
+// Should the seller cut the price below the offer, the lower price wins.
+// Open offers are unique per buyer and item so at most one row matches.
+const cartPriceSQL = `COALESCE((
+		SELECT LEAST(o.amount, i.price) FROM offers o
+		WHERE o.item_id = i.id AND o.buyer_id = c.user_id
+		AND o.status = 'accepted' AND o.expires_at > CURRENT_TIMESTAMP), i.price)`
+
+// Offer is a negotiation between a buyer and the seller of an item. The
+// side that did not make the latest offer is the one to respond.
+type Offer struct {
+	ID          string    `json:"id"`
+	ItemID      string    `json:"item_id"`
+	ItemTitle   string    `json:"item_title"`
+	ListPrice   float64   `json:"list_price"`
+	BuyerID     string    `json:"buyer_id"`
+	SellerID    string    `json:"seller_id"`
+	Amount      float64   `json:"amount"`
+	Status      string    `json:"status"`
+	LastOfferBy string    `json:"last_offer_by"`
+	ExpiresAt   time.Time `json:"expires_at"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+const offerColumns = `o.id, o.item_id, i.title, i.price, o.buyer_id, i.seller_id, o.amount,
+		o.status, o.last_offer_by, o.expires_at, o.created_at, o.updated_at`
+
+func scanOffer(row interface{ Scan(...interface{}) error }, offer *Offer) error {
+	return row.Scan(&offer.ID, &offer.ItemID, &offer.ItemTitle, &offer.ListPrice, &offer.BuyerID,
+		&offer.SellerID, &offer.Amount, &offer.Status, &offer.LastOfferBy, &offer.ExpiresAt,
+		&offer.CreatedAt, &offer.UpdatedAt)
+}
+
+func validateOfferAmount(amount, listPrice float64) error {
+	if amount <= 0 {
+		return fmt.Errorf("amount must be greater than zero")
+	}
+	if amount >= listPrice {
+		return fmt.Errorf("amount must be below the listed price of %.2f", listPrice)
+	}
+	return nil
+}
+
+func offersHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		listOffers(w, r)
+	case http.MethodPost:
+		createOffer(w, r)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// listOffers returns the offers the user made or received, newest first.
+// ?role=buyer or ?role=seller narrows the list to one side and ?status to
+// one state.
+func listOffers(w http.ResponseWriter, r *http.Request) {
+	userID, _ := getUserIDFromContext(r.Context())
+
+	keys := newestFirstKeys("o")
+	page, err := parsePageRequest(r, "offers", keys)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var filter string
+	switch r.URL.Query().Get("role") {
+	case "":
+		filter = "(o.buyer_id = $1 OR i.seller_id = $1)"
+	case "buyer":
+		filter = "o.buyer_id = $1"
+	case "seller":
+		filter = "i.seller_id = $1"
+	default:
+		http.Error(w, "role must be buyer or seller", http.StatusBadRequest)
+		return
+	}
+	args := []interface{}{userID}
+
+	if status := r.URL.Query().Get("status"); status != "" {
+		args = append(args, status)
+		filter += fmt.Sprintf(" AND o.status::text = $%d", len(args))
+	}
+
+	total, err := page.countTotal(`
+		SELECT COUNT(*) FROM offers o
+		JOIN items i ON o.item_id = i.id
+		WHERE `+filter, args...)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if cond, pageArgs := page.where(keys, len(args)+1); cond != "" {
+		filter += " AND " + cond
+		args = append(args, pageArgs...)
+	}
+
+	rows, err := db.Query(`
+		SELECT `+offerColumns+`
+		FROM offers o
+		JOIN items i ON o.item_id = i.id
+		WHERE `+filter+`
+		ORDER BY `+orderByKeys(keys)+page.limitClause(),
+		args...)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	offers := make([]Offer, 0)
+	for rows.Next() {
+		var offer Offer
+		if err := scanOffer(rows, &offer); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		offers = append(offers, offer)
+	}
+
+	result := Page{Total: total}
+	if page.hasMore(len(offers)) {
+		offers = offers[:page.limit]
+		last := offers[len(offers)-1]
+		result.NextCursor = page.nextCursor(keys, createdAtCursorValues(last.CreatedAt, last.ID))
+	}
+	result.Items = offers
+
+	sendJSON(w, result)
+}
+
+func createOffer(w http.ResponseWriter, r *http.Request) {
+	userID, _ := getUserIDFromContext(r.Context())
+
+	var req struct {
+		ItemID string  `json:"item_id"`
+		Amount float64 `json:"amount"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var sellerID, title string
+	var price float64
+	err = tx.QueryRow(`
+		SELECT seller_id, title, price FROM items
+		WHERE id = $1 AND status = 'available' AND quantity > 0 AND deleted_at IS NULL`,
+		req.ItemID).Scan(&sellerID, &title, &price)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Item not found or unavailable", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if sellerID == userID {
+		http.Error(w, "Cannot make an offer on your own item", http.StatusBadRequest)
+		return
+	}
+
+	auctioned, err := anyInOpenAuction(tx, []string{req.ItemID})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if auctioned {
+		http.Error(w, "This item is being auctioned, place a bid instead", http.StatusBadRequest)
+		return
+	}
+
+	vacation, err := getActiveVacation(tx, sellerID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if vacation != nil {
+		http.Error(w, fmt.Sprintf("Seller is on vacation until %s", vacation.EndsAt.Format("2 January 2006")), http.StatusBadRequest)
+		return
+	}
+
+	if err := validateOfferAmount(req.Amount, price); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var offerID string
+	err = tx.QueryRow(`
+		INSERT INTO offers (item_id, buyer_id, amount, last_offer_by, expires_at)
+		VALUES ($1, $2, $3, $2, $4)
+		RETURNING id`,
+		req.ItemID, userID, req.Amount, time.Now().Add(offerResponseWindow)).Scan(&offerID)
+	if err != nil {
+		if pgErr, ok := err.(*pq.Error); ok && pgErr.Code == "23505" {
+			http.Error(w, "You already have an open offer on this item", http.StatusConflict)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = createNotification(tx, sellerID, "offer", offerID,
+		fmt.Sprintf("New offer of %.2f for %s (listed at %.2f)", req.Amount, title, price))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var offer Offer
+	err = scanOffer(tx.QueryRow(`
+		SELECT `+offerColumns+`
+		FROM offers o
+		JOIN items i ON o.item_id = i.id
+		WHERE o.id = $1`, offerID), &offer)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err = tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	sendJSON(w, offer)
+}
+
+// respondToOfferHandler lets the side whose turn it is accept, counter or
+// decline an open offer, and the side that made the latest offer withdraw
+// it.
+func respondToOfferHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, _ := getUserIDFromContext(r.Context())
+	offerID := r.URL.Query().Get("id")
+
+	var req struct {
+		Action string  `json:"action"`
+		Amount float64 `json:"amount"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var offer Offer
+	var itemStatus string
+	var quantity int
+	err = tx.QueryRow(`
+		SELECT `+offerColumns+`, i.status, i.quantity
+		FROM offers o
+		JOIN items i ON o.item_id = i.id
+		WHERE o.id = $1 AND (o.buyer_id = $2 OR i.seller_id = $2) AND i.deleted_at IS NULL
+		FOR UPDATE OF o`,
+		offerID, userID).Scan(&offer.ID, &offer.ItemID, &offer.ItemTitle, &offer.ListPrice, &offer.BuyerID,
+		&offer.SellerID, &offer.Amount, &offer.Status, &offer.LastOfferBy, &offer.ExpiresAt,
+		&offer.CreatedAt, &offer.UpdatedAt, &itemStatus, &quantity)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Offer not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if offer.Status != "pending" || !offer.ExpiresAt.After(time.Now()) {
+		http.Error(w, "Offer is no longer open", http.StatusBadRequest)
+		return
+	}
+
+	otherID := offer.SellerID
+	if userID == offer.SellerID {
+		otherID = offer.BuyerID
+	}
+
+	if req.Action == "withdraw" {
+		if offer.LastOfferBy != userID {
+			http.Error(w, "Only the latest offer can be withdrawn by whoever made it", http.StatusBadRequest)
+			return
+		}
+	} else if offer.LastOfferBy == userID {
+		http.Error(w, "Waiting for the other side to respond", http.StatusBadRequest)
+		return
+	}
+
+	var message string
+	switch req.Action {
+	case "accept":
+		if itemStatus != "available" || quantity <= 0 {
+			http.Error(w, "Item is no longer available", http.StatusBadRequest)
+			return
+		}
+		offer.Status = "accepted"
+		offer.ExpiresAt = time.Now().Add(offerCheckoutWindow)
+		message = fmt.Sprintf("Your offer of %.2f for %s was accepted", offer.Amount, offer.ItemTitle)
+		if otherID == offer.SellerID {
+			message = fmt.Sprintf("Your counter offer of %.2f for %s was accepted", offer.Amount, offer.ItemTitle)
+		} else {
+			message += fmt.Sprintf(". Check out by %s to get this price", offer.ExpiresAt.Format("2 January 15:04"))
+		}
+
+	case "counter":
+		if err := validateOfferAmount(req.Amount, offer.ListPrice); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		offer.Amount = req.Amount
+		offer.LastOfferBy = userID
+		offer.ExpiresAt = time.Now().Add(offerResponseWindow)
+		message = fmt.Sprintf("Counter offer of %.2f for %s", offer.Amount, offer.ItemTitle)
+
+	case "decline":
+		offer.Status = "declined"
+		message = fmt.Sprintf("Your offer of %.2f for %s was declined", offer.Amount, offer.ItemTitle)
+
+	case "withdraw":
+		offer.Status = "withdrawn"
+		message = fmt.Sprintf("The offer of %.2f for %s was withdrawn", offer.Amount, offer.ItemTitle)
+
+	default:
+		http.Error(w, "action must be accept, counter, decline or withdraw", http.StatusBadRequest)
+		return
+	}
+
+	err = tx.QueryRow(`
+		UPDATE offers
+		SET status = $1::offer_status_enum, amount = $2, last_offer_by = $3, expires_at = $4
+		WHERE id = $5
+		RETURNING updated_at`,
+		offer.Status, offer.Amount, offer.LastOfferBy, offer.ExpiresAt, offer.ID).Scan(&offer.UpdatedAt)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := createNotification(tx, otherID, "offer", offer.ID, message); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err = tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	sendJSON(w, offer)
+}
+
+// completeOffers marks the accepted offers used by an order so they cannot
+// be applied again
+func completeOffers(tx *sql.Tx, buyerID, orderID string) error {
+	_, err := tx.Exec(`
+		UPDATE offers
+		SET status = 'completed'
+		WHERE buyer_id = $1 AND status = 'accepted' AND expires_at > CURRENT_TIMESTAMP
+		AND item_id IN (SELECT item_id FROM order_items WHERE order_id = $2)`,
+		buyerID, orderID)
+	return err
+}
+
+// expireOffers closes offers nobody answered in time and accepted offers
+// the buyer did not check out, telling whoever was waiting.
+func expireOffers() (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`
+		UPDATE offers o
+		SET status = 'expired'
+		FROM items i, offers prev
+		WHERE i.id = o.item_id AND prev.id = o.id
+		AND o.status IN ('pending', 'accepted')
+		AND o.expires_at <= CURRENT_TIMESTAMP
+		RETURNING o.id, o.amount, o.buyer_id, o.last_offer_by, prev.status, i.title`)
+	if err != nil {
+		return 0, err
+	}
+
+	type expiredOffer struct {
+		id, buyerID, lastOfferBy, status, title string
+		amount                                  float64
+	}
+	var expired []expiredOffer
+	for rows.Next() {
+		var e expiredOffer
+		if err := rows.Scan(&e.id, &e.amount, &e.buyerID, &e.lastOfferBy, &e.status, &e.title); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		expired = append(expired, e)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for _, e := range expired {
+		userID := e.lastOfferBy
+		message := fmt.Sprintf("Your offer of %.2f for %s expired without a response", e.amount, e.title)
+		if e.status == "accepted" {
+			userID = e.buyerID
+			message = fmt.Sprintf("The accepted offer of %.2f for %s expired before checkout", e.amount, e.title)
+		}
+		if err := createNotification(tx, userID, "offer", e.id, message); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(expired), tx.Commit()
+}
+
+func startOfferExpirer(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		n, err := expireOffers()
+		if err != nil {
+			log.Printf("Error expiring offers: %v", err)
+			continue
+		}
+		if n > 0 {
+			log.Printf("Expired %d offers", n)
+		}
+	}
+}
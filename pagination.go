@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultPageLimit = 20
+	maxPageLimit     = 100
+)
+
+var errInvalidCursor = errors.New("invalid cursor")
+
+// Page is the envelope returned by every paginated listing. NextCursor is
+// empty on the last page; Total is only included when include_total=true.
+type Page struct {
+	Items      interface{} `json:"items"`
+	NextCursor string      `json:"next_cursor,omitempty"`
+	Total      *int        `json:"total,omitempty"`
+}
+
+// sortKey is one column of a keyset ordering. The last key of every
+// ordering must be unique (normally the id) so pages never overlap.
+type sortKey struct {
+	name string // key in the row values passed to nextCursor
+	expr string // SQL expression the rows are ordered by
+	cast string // Postgres type the cursor value is cast to
+	desc bool
+}
+
+// pageRequest holds the pagination parameters of a request. After contains
+// the sort key values of the last row of the previous page, or nil for the
+// first page.
+type pageRequest struct {
+	limit        int
+	after        []string
+	includeTotal bool
+	scope        string
+}
+
+type cursorPayload struct {
+	Scope  string   `json:"s"`
+	Values []string `json:"v"`
+}
+
+// parsePageRequest reads limit, cursor and include_total from the query.
+// Cursors are bound to a scope (the endpoint and its sort order) so one
+// taken from a different listing is rejected rather than misread.
+func parsePageRequest(r *http.Request, scope string, keys []sortKey) (pageRequest, error) {
+	q := r.URL.Query()
+	page := pageRequest{
+		limit:        defaultPageLimit,
+		includeTotal: q.Get("include_total") == "true",
+		scope:        scope,
+	}
+
+	if limit := q.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 {
+			return page, fmt.Errorf("limit must be a positive integer")
+		}
+		if n > maxPageLimit {
+			n = maxPageLimit
+		}
+		page.limit = n
+	}
+
+	if cursor := q.Get("cursor"); cursor != "" {
+		data, err := base64.RawURLEncoding.DecodeString(cursor)
+		if err != nil {
+			return page, errInvalidCursor
+		}
+		var payload cursorPayload
+		if err := json.Unmarshal(data, &payload); err != nil {
+			return page, errInvalidCursor
+		}
+		if payload.Scope != scope || len(payload.Values) != len(keys) {
+			return page, errInvalidCursor
+		}
+		page.after = payload.Values
+	}
+
+	return page, nil
+}
+
+// where returns a condition selecting the rows after the cursor, using
+// placeholders from $firstParam on, or "" on the first page. Sort keys may
+// mix directions, so the row comparison is spelled out key by key.
+func (p pageRequest) where(keys []sortKey, firstParam int) (string, []interface{}) {
+	if p.after == nil {
+		return "", nil
+	}
+
+	var args []interface{}
+	placeholders := make([]string, len(keys))
+	for i, key := range keys {
+		placeholders[i] = fmt.Sprintf("$%d::%s", firstParam+i, key.cast)
+		args = append(args, p.after[i])
+	}
+
+	var alternatives []string
+	for i, key := range keys {
+		var terms []string
+		for j := 0; j < i; j++ {
+			terms = append(terms, fmt.Sprintf("%s = %s", keys[j].expr, placeholders[j]))
+		}
+		op := ">"
+		if key.desc {
+			op = "<"
+		}
+		terms = append(terms, fmt.Sprintf("%s %s %s", key.expr, op, placeholders[i]))
+		alternatives = append(alternatives, "("+strings.Join(terms, " AND ")+")")
+	}
+
+	return "(" + strings.Join(alternatives, " OR ") + ")", args
+}
+
+// limitClause fetches one row beyond the page to learn whether another
+// page follows.
+func (p pageRequest) limitClause() string {
+	return fmt.Sprintf(" LIMIT %d", p.limit+1)
+}
+
+func orderByKeys(keys []sortKey) string {
+	terms := make([]string, len(keys))
+	for i, key := range keys {
+		terms[i] = key.expr
+		if key.desc {
+			terms[i] += " DESC"
+		}
+	}
+	return strings.Join(terms, ", ")
+}
+
+// hasMore reports whether the query returned the extra row requested by
+// limitClause. Callers then drop the extra row and build the next cursor
+// from the last row they keep.
+func (p pageRequest) hasMore(rows int) bool {
+	return rows > p.limit
+}
+
+// nextCursor encodes the sort key values of the last row on a page
+func (p pageRequest) nextCursor(keys []sortKey, values map[string]string) string {
+	payload := cursorPayload{Scope: p.scope, Values: make([]string, len(keys))}
+	for i, key := range keys {
+		payload.Values[i] = values[key.name]
+	}
+	data, _ := json.Marshal(payload)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// countTotal runs a count query for pages that asked for the total
+func (p pageRequest) countTotal(query string, args ...interface{}) (*int, error) {
+	if !p.includeTotal {
+		return nil, nil
+	}
+	var total int
+	if err := db.QueryRow(query, args...).Scan(&total); err != nil {
+		return nil, err
+	}
+	return &total, nil
+}
+
+// newestFirstKeys orders rows of the given table alias by creation time,
+// newest first, with the id breaking ties.
+func newestFirstKeys(alias string) []sortKey {
+	return []sortKey{
+		{"created_at", alias + ".created_at", "timestamptz", true},
+		{"id", alias + ".id", "uuid", false},
+	}
+}
+
+// oldestFirstKeys is newestFirstKeys in chronological order
+func oldestFirstKeys(alias string) []sortKey {
+	return []sortKey{
+		{"created_at", alias + ".created_at", "timestamptz", false},
+		{"id", alias + ".id", "uuid", false},
+	}
+}
+
+func createdAtCursorValues(createdAt time.Time, id string) map[string]string {
+	return map[string]string{
+		"created_at": createdAt.Format(time.RFC3339Nano),
+		"id":         id,
+	}
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	_ "embed"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	defaultPickupRadiusKm = 10
+	maxPickupRadiusKm     = 500
+)
+
+// The bundled dataset maps German postal regions (the first two digits of
+// a postcode) to the coordinates of their main town, which is accurate to
+// a few tens of kilometres. Set POSTCODE_DATA to a CSV in the same format
+// with full postcodes for finer results; lookups fall back to shorter
+// prefixes, so both can be mixed in one file.
+//
+//go:embed data/postcodes_de.csv
+var bundledPostcodes []byte
+
+type coordinates struct {
+	Latitude  float64
+	Longitude float64
+}
+
+var postcodeCoordinates map[string]coordinates
+
+func loadPostcodes() {
+	data := bundledPostcodes
+	if path := os.Getenv("POSTCODE_DATA"); path != "" {
+		var err error
+		data, err = os.ReadFile(path)
+		if err != nil {
+			log.Fatalf("Error reading POSTCODE_DATA: %v", err)
+		}
+	}
+
+	coords, err := parsePostcodes(bytes.NewReader(data))
+	if err != nil {
+		log.Fatalf("Error loading postcodes: %v", err)
+	}
+	postcodeCoordinates = coords
+}
+
+// parsePostcodes reads postcode,latitude,longitude rows after a header row.
+// Further columns are ignored.
+func parsePostcodes(r io.Reader) (map[string]coordinates, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+
+	if _, err := reader.Read(); err != nil {
+		return nil, fmt.Errorf("reading header: %v", err)
+	}
+
+	coords := make(map[string]coordinates)
+	for {
+		row, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(row) < 3 {
+			return nil, fmt.Errorf("line %d: expected postcode, latitude and longitude", len(coords)+2)
+		}
+
+		lat, latErr := strconv.ParseFloat(row[1], 64)
+		lon, lonErr := strconv.ParseFloat(row[2], 64)
+		if latErr != nil || lonErr != nil || math.Abs(lat) > 90 || math.Abs(lon) > 180 {
+			return nil, fmt.Errorf("invalid coordinates for postcode %q", row[0])
+		}
+		coords[normalizePostcode(row[0])] = coordinates{lat, lon}
+	}
+	return coords, nil
+}
+
+func normalizePostcode(postcode string) string {
+	return strings.ToUpper(strings.Join(strings.Fields(postcode), ""))
+}
+
+// lookupPostcode returns the coordinates of a postcode, using the longest
+// prefix present in the dataset.
+func lookupPostcode(postcode string) (coordinates, bool) {
+	code := normalizePostcode(postcode)
+	for n := len(code); n >= 2; n-- {
+		if c, ok := postcodeCoordinates[code[:n]]; ok {
+			return c, true
+		}
+	}
+	return coordinates{}, false
+}
+
+// distanceKmSQL returns an expression for the great-circle distance in km
+// from origin to the pickup location of the seller of items i, or NULL
+// when the seller has none. The coordinates come from the postcode
+// dataset, never from user input, so they are inlined as literals.
+func distanceKmSQL(origin coordinates) string {
+	return fmt.Sprintf(`(SELECT 12742 * asin(LEAST(1, sqrt(
+			power(sin(radians(pl.latitude - %[1]f) / 2), 2) +
+			cos(radians(%[1]f)) * cos(radians(pl.latitude)) *
+			power(sin(radians(pl.longitude - %[2]f) / 2), 2))))
+		FROM pickup_locations pl WHERE pl.user_id = i.seller_id)`,
+		origin.Latitude, origin.Longitude)
+}
+
+type PickupLocation struct {
+	Postcode  string    `json:"postcode"`
+	Latitude  float64   `json:"latitude"`
+	Longitude float64   `json:"longitude"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+func pickupLocationHandler(w http.ResponseWriter, r *http.Request) {
+	userID, _ := getUserIDFromContext(r.Context())
+
+	switch r.Method {
+	case http.MethodGet:
+		var loc PickupLocation
+		err := db.QueryRow(`
+			SELECT postcode, latitude, longitude, updated_at
+			FROM pickup_locations
+			WHERE user_id = $1`,
+			userID).Scan(&loc.Postcode, &loc.Latitude, &loc.Longitude, &loc.UpdatedAt)
+
+		if err == sql.ErrNoRows {
+			sendJSON(w, nil)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		sendJSON(w, loc)
+
+	case http.MethodPut:
+		var loc PickupLocation
+		if err := json.NewDecoder(r.Body).Decode(&loc); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		loc.Postcode = normalizePostcode(loc.Postcode)
+		coords, ok := lookupPostcode(loc.Postcode)
+		if !ok {
+			http.Error(w, "Unknown postcode", http.StatusBadRequest)
+			return
+		}
+		loc.Latitude, loc.Longitude = coords.Latitude, coords.Longitude
+
+		err := db.QueryRow(`
+			INSERT INTO pickup_locations (user_id, postcode, latitude, longitude)
+			VALUES ($1, $2, $3, $4)
+			ON CONFLICT (user_id) DO UPDATE
+			SET postcode = EXCLUDED.postcode,
+				latitude = EXCLUDED.latitude,
+				longitude = EXCLUDED.longitude,
+				updated_at = CURRENT_TIMESTAMP
+			RETURNING updated_at`,
+			userID, loc.Postcode, loc.Latitude, loc.Longitude).Scan(&loc.UpdatedAt)
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		sendJSON(w, loc)
+
+	case http.MethodDelete:
+		tx, err := db.Begin()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+
+		_, err = tx.Exec(`DELETE FROM pickup_locations WHERE user_id = $1`, userID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		// Without a location there is nowhere to collect from
+		_, err = tx.Exec(`UPDATE items SET local_pickup = false WHERE seller_id = $1 AND local_pickup`, userID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if err := tx.Commit(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// hasPickupLocation reports whether a seller can offer local pickup
+func hasPickupLocation(q queryRower, userID string) (bool, error) {
+	var exists bool
+	err := q.QueryRow(`SELECT EXISTS (SELECT 1 FROM pickup_locations WHERE user_id = $1)`, userID).Scan(&exists)
+	return exists, err
+}
+
+// updateItemPickupHandler turns local pickup on or off for one of the
+// seller's listings
+func updateItemPickupHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, _ := getUserIDFromContext(r.Context())
+	itemID := r.URL.Query().Get("id")
+	if _, err := uuid.Parse(itemID); err != nil {
+		http.Error(w, "Item not found", http.StatusNotFound)
+		return
+	}
+
+	var req struct {
+		LocalPickup bool `json:"local_pickup"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	if req.LocalPickup {
+		// Keeps the location from being deleted until the listing is updated
+		err := tx.QueryRow(`SELECT 1 FROM pickup_locations WHERE user_id = $1 FOR SHARE`, userID).Scan(new(int))
+		if err == sql.ErrNoRows {
+			http.Error(w, "Set a pickup location before offering local pickup", http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	result, err := tx.Exec(`
+		UPDATE items SET local_pickup = $1
+		WHERE id = $2 AND seller_id = $3 AND deleted_at IS NULL`,
+		req.LocalPickup, itemID, userID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		http.Error(w, "Item not found or not authorized", http.StatusNotFound)
+		return
+	}
+
+	if err = tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	sendJSON(w, map[string]interface{}{
+		"id":           itemID,
+		"local_pickup": req.LocalPickup,
+	})
+}
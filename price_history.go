@@ -0,0 +1,85 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Listings whose price was lowered within this period count as recently
+// reduced in search
+const recentlyReducedPeriod = 14 * 24 * time.Hour
+
+// PriceChange is one entry of an item's price history. The first entry is
+// the price the item was listed at and has no previous price.
+type PriceChange struct {
+	Price         float64   `json:"price"`
+	PreviousPrice *float64  `json:"previous_price,omitempty"`
+	ChangedAt     time.Time `json:"changed_at"`
+}
+
+// itemPriceHistoryHandler serves GET /items/{id}/price-history, oldest
+// change first. The history itself is recorded by a trigger on items.
+func itemPriceHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	itemID := strings.TrimPrefix(r.URL.Path, "/items/")
+	itemID = strings.TrimSuffix(itemID, "/price-history")
+	if _, err := uuid.Parse(itemID); err != nil {
+		http.Error(w, "Item not found", http.StatusNotFound)
+		return
+	}
+
+	var price float64
+	err := db.QueryRow(`SELECT price FROM items WHERE id = $1 AND deleted_at IS NULL`, itemID).Scan(&price)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Item not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	rows, err := db.Query(`
+		SELECT price, previous_price, changed_at
+		FROM item_price_history
+		WHERE item_id = $1
+		ORDER BY changed_at, id`,
+		itemID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	history := make([]PriceChange, 0)
+	for rows.Next() {
+		var change PriceChange
+		var previous sql.NullFloat64
+		if err := rows.Scan(&change.Price, &previous, &change.ChangedAt); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if previous.Valid {
+			change.PreviousPrice = &previous.Float64
+		}
+		history = append(history, change)
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	sendJSON(w, map[string]interface{}{
+		"item_id": itemID,
+		"price":   price,
+		"history": history,
+	})
+}
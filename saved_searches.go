@@ -0,0 +1,531 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+// New items are matched against saved searches in batches of this size
+const savedSearchMatchBatch = 500
+
+// Matches shown in a digest email; the rest are only counted
+const maxDigestEmailItems = 10
+
+type SavedSearch struct {
+	ID          string    `json:"id"`
+	Name        string    `json:"name"`
+	Query       string    `json:"query"`
+	Frequency   string    `json:"frequency"`
+	EmailDigest bool      `json:"email_digest"`
+	Muted       bool      `json:"muted"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+var savedSearchFrequencies = map[string]bool{
+	"instant": true, "daily": true, "weekly": true,
+}
+
+// normalizeSavedSearchQuery validates a search query string in the format
+// accepted by /items/search and keeps only the filter parameters. Sorting
+// and paging do not affect which items match.
+func normalizeSavedSearchQuery(raw string) (string, error) {
+	params, err := url.ParseQuery(strings.TrimPrefix(raw, "?"))
+	if err != nil {
+		return "", fmt.Errorf("invalid query: %v", err)
+	}
+
+	// Saved searches are matched once when a listing is published, before
+	// it can have been reduced, so the filter would never match anything
+	if params.Get("reduced") == "true" || params.Get("sort") == "reduced" {
+		return "", fmt.Errorf("recently reduced searches cannot be saved, add the items to your favorites to hear about price drops")
+	}
+
+	saved := url.Values{}
+	for _, key := range []string{"q", "category", "size", "condition", "seller_id", "min_price", "max_price", "near", "radius_km"} {
+		if value := strings.TrimSpace(params.Get(key)); value != "" {
+			saved.Set(key, value)
+		}
+	}
+
+	if category := saved.Get("category"); category != "" && !validCategories[category] {
+		return "", fmt.Errorf("invalid category: %q", category)
+	}
+	if size := saved.Get("size"); size != "" && !validSizes[size] {
+		return "", fmt.Errorf("invalid size: %q", size)
+	}
+	if condition := saved.Get("condition"); condition != "" && !validConditions[condition] {
+		return "", fmt.Errorf("invalid condition: %q", condition)
+	}
+	if sellerID := saved.Get("seller_id"); sellerID != "" {
+		if _, err := uuid.Parse(sellerID); err != nil {
+			return "", fmt.Errorf("invalid seller_id: %q", sellerID)
+		}
+	}
+	for _, key := range []string{"min_price", "max_price"} {
+		if price := saved.Get(key); price != "" {
+			if _, err := strconv.ParseFloat(price, 64); err != nil {
+				return "", fmt.Errorf("invalid %s: %q", key, price)
+			}
+		}
+	}
+
+	switch free := params.Get("free"); free {
+	case "true":
+		saved.Set("free", free)
+	case "", "false":
+	default:
+		return "", fmt.Errorf("invalid free: %q", free)
+	}
+
+	if _, _, err := searchOriginFromQuery(saved); err != nil {
+		return "", err
+	}
+
+	if len(saved) == 0 {
+		return "", fmt.Errorf("a saved search needs at least one filter")
+	}
+	return saved.Encode(), nil
+}
+
+func validateSavedSearch(s *SavedSearch) error {
+	s.Name = strings.TrimSpace(s.Name)
+	if s.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+	if len(s.Name) > 255 {
+		return fmt.Errorf("name must be at most 255 characters")
+	}
+
+	if s.Frequency == "" {
+		s.Frequency = "instant"
+	}
+	if !savedSearchFrequencies[s.Frequency] {
+		return fmt.Errorf("frequency must be instant, daily or weekly")
+	}
+	if s.EmailDigest && s.Frequency == "instant" {
+		return fmt.Errorf("email digests need a daily or weekly frequency")
+	}
+	return nil
+}
+
+func savedSearchesHandler(w http.ResponseWriter, r *http.Request) {
+	userID, _ := getUserIDFromContext(r.Context())
+
+	switch r.Method {
+	case http.MethodGet:
+		rows, err := db.Query(`
+			SELECT id, name, query, frequency, email_digest, muted, created_at
+			FROM saved_searches
+			WHERE user_id = $1
+			ORDER BY created_at DESC`,
+			userID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		searches := make([]SavedSearch, 0)
+		for rows.Next() {
+			var s SavedSearch
+			err := rows.Scan(&s.ID, &s.Name, &s.Query, &s.Frequency, &s.EmailDigest, &s.Muted, &s.CreatedAt)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			searches = append(searches, s)
+		}
+
+		sendJSON(w, searches)
+
+	case http.MethodPost:
+		var s SavedSearch
+		if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		query, err := normalizeSavedSearchQuery(s.Query)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.Query = query
+
+		if err := validateSavedSearch(&s); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		err = db.QueryRow(`
+			INSERT INTO saved_searches (user_id, name, query, frequency, email_digest, muted)
+			VALUES ($1, $2, $3, $4::saved_search_frequency_enum, $5, $6)
+			RETURNING id, created_at`,
+			userID, s.Name, s.Query, s.Frequency, s.EmailDigest, s.Muted).Scan(&s.ID, &s.CreatedAt)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		sendJSON(w, s)
+
+	case http.MethodPut:
+		// The query itself is fixed; changing it makes a different search
+		searchID := r.URL.Query().Get("id")
+
+		var s SavedSearch
+		if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := validateSavedSearch(&s); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// Matches found while muted were never recorded, so unmuting does not
+		// flood the user with everything listed in the meantime
+		err := db.QueryRow(`
+			UPDATE saved_searches
+			SET name = $1, frequency = $2::saved_search_frequency_enum,
+				email_digest = $3, muted = $4
+			WHERE id = $5 AND user_id = $6
+			RETURNING id, query, created_at`,
+			s.Name, s.Frequency, s.EmailDigest, s.Muted, searchID, userID).Scan(&s.ID, &s.Query, &s.CreatedAt)
+
+		if err == sql.ErrNoRows {
+			http.Error(w, "Saved search not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		sendJSON(w, s)
+
+	case http.MethodDelete:
+		searchID := r.URL.Query().Get("id")
+
+		result, err := db.Exec(`DELETE FROM saved_searches WHERE id = $1 AND user_id = $2`, searchID, userID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			http.Error(w, "Saved search not found", http.StatusNotFound)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// matchSavedSearches evaluates saved searches against listings that have
+// become visible since the last run. Instant searches notify right away;
+// daily and weekly searches collect matches for sendSavedSearchDigests.
+// More reports whether further listings are waiting to be matched.
+func matchSavedSearches() (matched int, more bool, err error) {
+	rows, err := db.Query(`
+		SELECT i.id FROM items i
+		WHERE i.search_matched_at IS NULL AND `+searchableItemsSQL+`
+		ORDER BY i.created_at
+		LIMIT $1`,
+		savedSearchMatchBatch)
+	if err != nil {
+		return 0, false, err
+	}
+
+	var itemIDs []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, false, err
+		}
+		itemIDs = append(itemIDs, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, false, err
+	}
+	if len(itemIDs) == 0 {
+		return 0, false, nil
+	}
+
+	rows, err = db.Query(`
+		SELECT id, user_id, name, query, frequency
+		FROM saved_searches
+		WHERE NOT muted`)
+	if err != nil {
+		return 0, false, err
+	}
+
+	type search struct {
+		id, userID, name, query, frequency string
+	}
+	var searches []search
+	for rows.Next() {
+		var s search
+		if err := rows.Scan(&s.id, &s.userID, &s.name, &s.query, &s.frequency); err != nil {
+			rows.Close()
+			return 0, false, err
+		}
+		searches = append(searches, s)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, false, err
+	}
+
+	for _, s := range searches {
+		n, err := matchSavedSearch(s.id, s.userID, s.name, s.query, s.frequency == "instant", itemIDs)
+		if err != nil {
+			// One broken search should not hold up everyone else's
+			log.Printf("Error matching saved search %s: %v", s.id, err)
+			continue
+		}
+		matched += n
+	}
+
+	_, err = db.Exec(`UPDATE items SET search_matched_at = CURRENT_TIMESTAMP WHERE id = ANY($1)`,
+		pq.Array(itemIDs))
+	return matched, len(itemIDs) == savedSearchMatchBatch, err
+}
+
+func matchSavedSearch(searchID, userID, name, query string, instant bool, itemIDs []string) (int, error) {
+	params, err := url.ParseQuery(query)
+	if err != nil {
+		return 0, err
+	}
+	filters, _ := searchFiltersFromQuery(params)
+	origin, radiusKm, err := searchOriginFromQuery(params)
+	if err != nil {
+		return 0, err
+	}
+	if origin != nil {
+		filters = append(filters, searchDistanceFilter(*origin, radiusKm))
+	}
+	filterSQL, args := searchFilterSQL(filters, "")
+	n := len(args)
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	// Sellers are not told about their own listings
+	rows, err := tx.Query(fmt.Sprintf(`
+		WITH inserted AS (
+			INSERT INTO saved_search_matches (saved_search_id, item_id, notified)
+			SELECT $%d, i.id, $%d FROM items i
+			WHERE i.id = ANY($%d) AND i.seller_id <> $%d AND `+searchableItemsSQL+filterSQL+`
+			ON CONFLICT (saved_search_id, item_id) DO NOTHING
+			RETURNING item_id
+		)
+		SELECT i.id, i.title FROM inserted JOIN items i ON i.id = inserted.item_id`,
+		n+1, n+2, n+3, n+4),
+		append(args, searchID, instant, pq.Array(itemIDs), userID)...)
+	if err != nil {
+		return 0, err
+	}
+
+	type match struct{ itemID, title string }
+	var matches []match
+	for rows.Next() {
+		var m match
+		if err := rows.Scan(&m.itemID, &m.title); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		matches = append(matches, m)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	if instant {
+		for _, m := range matches {
+			err := createNotification(tx, userID, "saved_search", m.itemID,
+				fmt.Sprintf("New listing for your search %q: %s", name, m.title))
+			if err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	return len(matches), tx.Commit()
+}
+
+// sendSavedSearchDigests sends one notification, and optionally an email,
+// for each daily or weekly search whose period has elapsed and that has
+// collected matches.
+func sendSavedSearchDigests() (int, error) {
+	rows, err := db.Query(`
+		SELECT s.id, s.user_id, s.name, s.query, s.email_digest, u.email
+		FROM saved_searches s
+		JOIN users u ON s.user_id = u.id
+		WHERE NOT s.muted
+		AND s.frequency <> 'instant'
+		AND s.last_digest_at <= CURRENT_TIMESTAMP - CASE s.frequency
+				WHEN 'daily' THEN INTERVAL '1 day'
+				ELSE INTERVAL '7 days'
+			END
+		AND EXISTS (
+				SELECT 1 FROM saved_search_matches m
+				WHERE m.saved_search_id = s.id AND NOT m.notified
+		)`)
+	if err != nil {
+		return 0, err
+	}
+
+	type digest struct {
+		id, userID, name, query, email string
+		emailDigest                    bool
+	}
+	var digests []digest
+	for rows.Next() {
+		var d digest
+		if err := rows.Scan(&d.id, &d.userID, &d.name, &d.query, &d.emailDigest, &d.email); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		digests = append(digests, d)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	var sent int
+	for _, d := range digests {
+		titles, total, err := sendSavedSearchDigest(d.id, d.userID, d.name)
+		if err != nil {
+			log.Printf("Error sending digest for saved search %s: %v", d.id, err)
+			continue
+		}
+		if total == 0 {
+			continue
+		}
+		sent++
+
+		if d.emailDigest {
+			body := fmt.Sprintf("%d new listings match your saved search %q:\n\n", total, d.name)
+			for _, title := range titles {
+				body += "- " + title + "\n"
+			}
+			if total > len(titles) {
+				body += fmt.Sprintf("...and %d more\n", total-len(titles))
+			}
+			subject := fmt.Sprintf("New listings for %q", d.name)
+			if err := mailer.Send(d.email, subject, body); err != nil {
+				log.Printf("Error emailing digest for saved search %s: %v", d.id, err)
+			}
+		}
+	}
+	return sent, nil
+}
+
+// sendSavedSearchDigest marks a search's pending matches as notified and
+// records the digest notification. Matches whose listing has since gone
+// are dropped without being counted.
+func sendSavedSearchDigest(searchID, userID, name string) ([]string, int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, 0, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`
+		UPDATE saved_search_matches m
+		SET notified = true
+		FROM items i
+		WHERE m.saved_search_id = $1 AND NOT m.notified AND i.id = m.item_id
+		RETURNING i.title, `+searchableItemsSQL,
+		searchID)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var titles []string
+	var total int
+	for rows.Next() {
+		var title string
+		var visible bool
+		if err := rows.Scan(&title, &visible); err != nil {
+			rows.Close()
+			return nil, 0, err
+		}
+		if !visible {
+			continue
+		}
+		total++
+		if len(titles) < maxDigestEmailItems {
+			titles = append(titles, title)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
+	}
+
+	if total > 0 {
+		err = createNotification(tx, userID, "saved_search_digest", searchID,
+			fmt.Sprintf("%d new listings match your search %q", total, name))
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+
+	_, err = tx.Exec(`UPDATE saved_searches SET last_digest_at = CURRENT_TIMESTAMP WHERE id = $1`, searchID)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return titles, total, tx.Commit()
+}
+
+// startSavedSearchMatcher periodically matches new listings against saved
+// searches and sends any digests that are due.
+func startSavedSearchMatcher(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		// Drain the backlog so a burst of imports is matched in one tick
+		for more := true; more; {
+			var n int
+			var err error
+			n, more, err = matchSavedSearches()
+			if err != nil {
+				log.Printf("Error matching saved searches: %v", err)
+				break
+			}
+			if n > 0 {
+				log.Printf("Matched %d new listings to saved searches", n)
+			}
+		}
+
+		n, err := sendSavedSearchDigests()
+		if err != nil {
+			log.Printf("Error sending saved search digests: %v", err)
+		} else if n > 0 {
+			log.Printf("Sent %d saved search digests", n)
+		}
+	}
+}
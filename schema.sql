@@ -1,11 +1,18 @@
 -- Create extensions
 CREATE EXTENSION IF NOT EXISTS "uuid-ossp";
+CREATE EXTENSION IF NOT EXISTS pg_trgm;
 
 -- Create enum types
 CREATE TYPE size_enum AS ENUM ('XS', 'S', 'M', 'L', 'XL');
 CREATE TYPE category_enum AS ENUM ('tops', 'bottoms', 'outerwear', 'footwear', 'accessories');
 CREATE TYPE order_status_enum AS ENUM ('pending', 'processing', 'shipped', 'delivered', 'cancelled');
-CREATE TYPE item_status_enum AS ENUM ('available', 'sold', 'reserved');
+CREATE TYPE item_status_enum AS ENUM ('available', 'sold', 'reserved', 'draft', 'scheduled', 'paused');
+CREATE TYPE item_condition_enum AS ENUM ('new_with_tags', 'like_new', 'good', 'fair');
+CREATE TYPE saved_search_frequency_enum AS ENUM ('instant', 'daily', 'weekly');
+CREATE TYPE trade_status_enum AS ENUM ('proposed', 'accepted', 'declined', 'withdrawn');
+CREATE TYPE offer_status_enum AS ENUM ('pending', 'accepted', 'declined', 'withdrawn', 'expired', 'completed');
+CREATE TYPE free_request_status_enum AS ENUM ('pending', 'accepted', 'declined', 'withdrawn');
+CREATE TYPE auction_status_enum AS ENUM ('open', 'sold', 'unsold', 'cancelled');
 
 -- Create users table
 CREATE TABLE IF NOT EXISTS users (
@@ -13,6 +20,7 @@ CREATE TABLE IF NOT EXISTS users (
     name VARCHAR(255) NOT NULL,
     email VARCHAR(255) UNIQUE NOT NULL,
     password_hash VARCHAR(255) NOT NULL,
+    is_admin BOOLEAN DEFAULT false,
     created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
 );
 
@@ -21,14 +29,33 @@ CREATE TABLE IF NOT EXISTS items (
     id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
     title VARCHAR(255) NOT NULL,
     description TEXT,
+    brand VARCHAR(100),
     price DECIMAL(10,2) NOT NULL,
     size size_enum NOT NULL,
     category category_enum NOT NULL,
+    condition item_condition_enum,
+    local_pickup BOOLEAN DEFAULT false,
+    is_free BOOLEAN DEFAULT false,
+    free_first_come BOOLEAN DEFAULT false,
+    -- Set when a moderator confirms a flag; the seller cannot republish
+    moderation_hold BOOLEAN DEFAULT false,
     status item_status_enum DEFAULT 'available',
     quantity INTEGER DEFAULT 1,
     seller_id UUID REFERENCES users(id),
+    publish_at TIMESTAMP WITH TIME ZONE,
+    deleted_at TIMESTAMP WITH TIME ZONE,
+    search_matched_at TIMESTAMP WITH TIME ZONE,
+    price_reduced_at TIMESTAMP WITH TIME ZONE,
     created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
-    CONSTRAINT quantity_non_negative CHECK (quantity >= 0)
+    -- Weighted so title matches rank above brand, and brand above description
+    search_vector tsvector GENERATED ALWAYS AS (
+        setweight(to_tsvector('english', coalesce(title, '')), 'A') ||
+        setweight(to_tsvector('english', coalesce(brand, '')), 'B') ||
+        setweight(to_tsvector('english', coalesce(description, '')), 'C')
+    ) STORED,
+    CONSTRAINT quantity_non_negative CHECK (quantity >= 0),
+    CONSTRAINT scheduled_has_publish_at CHECK (status <> 'scheduled' OR publish_at IS NOT NULL),
+    CONSTRAINT free_items_have_no_price CHECK (NOT is_free OR price = 0)
 );
 
 -- Create item_images table
@@ -36,6 +63,19 @@ CREATE TABLE IF NOT EXISTS item_images (
     id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
     item_id UUID REFERENCES items(id) ON DELETE CASCADE,
     image_path VARCHAR(255) NOT NULL,
+    phash BIGINT,
+    -- The hash split into eight 8-bit bands, each offset by 256 times its
+    -- position so equal bands only match at the same position
+    phash_bands INTEGER[] GENERATED ALWAYS AS (ARRAY[
+        ((phash >> 56) & 255)::int,
+        256 + ((phash >> 48) & 255)::int,
+        512 + ((phash >> 40) & 255)::int,
+        768 + ((phash >> 32) & 255)::int,
+        1024 + ((phash >> 24) & 255)::int,
+        1280 + ((phash >> 16) & 255)::int,
+        1536 + ((phash >> 8) & 255)::int,
+        1792 + (phash & 255)::int
+    ]) STORED,
     created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
 );
 
@@ -45,6 +85,10 @@ CREATE TABLE IF NOT EXISTS cart_items (
     user_id UUID REFERENCES users(id) ON DELETE CASCADE,
     item_id UUID REFERENCES items(id) ON DELETE CASCADE,
     added_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    -- Listed price when added, to warn the buyer if it changes
+    price_at_add DECIMAL(10,2),
+    -- Last activity on the whole cart, used to prune abandoned carts
+    touched_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
     UNIQUE(user_id, item_id)
 );
 
@@ -63,6 +107,26 @@ CREATE TABLE IF NOT EXISTS addresses (
     created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
 );
 
+-- Create trades table
+CREATE TABLE IF NOT EXISTS trades (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    proposer_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    recipient_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    proposer_address_id UUID NOT NULL REFERENCES addresses(id),
+    status trade_status_enum DEFAULT 'proposed',
+    message TEXT,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    CONSTRAINT trade_between_two_users CHECK (proposer_id <> recipient_id)
+);
+
+-- Create trade_items table
+CREATE TABLE IF NOT EXISTS trade_items (
+    trade_id UUID NOT NULL REFERENCES trades(id) ON DELETE CASCADE,
+    item_id UUID NOT NULL REFERENCES items(id) ON DELETE CASCADE,
+    PRIMARY KEY (trade_id, item_id)
+);
+
 -- Create orders table
 CREATE TABLE IF NOT EXISTS orders (
     id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
@@ -70,6 +134,10 @@ CREATE TABLE IF NOT EXISTS orders (
     address_id UUID REFERENCES addresses(id),
     total DECIMAL(10,2) NOT NULL,
     status order_status_enum DEFAULT 'pending',
+    -- Set on the two orders created when a swap is accepted
+    trade_id UUID REFERENCES trades(id),
+    -- Set once a cancelled order has put its items back in stock
+    restocked BOOLEAN DEFAULT false,
     created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
     updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
 );
@@ -99,6 +167,7 @@ CREATE TABLE IF NOT EXISTS messages (
     order_id UUID NOT NULL REFERENCES orders(id) ON DELETE CASCADE,
     sender_id UUID NOT NULL REFERENCES users(id),
     message TEXT NOT NULL,
+    is_auto_reply BOOLEAN DEFAULT false,
     created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
     CONSTRAINT chk_message_not_empty CHECK (message <> '')
 );
@@ -123,12 +192,182 @@ CREATE TABLE IF NOT EXISTS notifications (
     created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
 );
 
+-- Create saved_searches table
+CREATE TABLE IF NOT EXISTS saved_searches (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    name VARCHAR(255) NOT NULL,
+    query TEXT NOT NULL,
+    frequency saved_search_frequency_enum NOT NULL DEFAULT 'instant',
+    email_digest BOOLEAN DEFAULT false,
+    muted BOOLEAN DEFAULT false,
+    last_digest_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Create saved_search_matches table
+CREATE TABLE IF NOT EXISTS saved_search_matches (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    saved_search_id UUID NOT NULL REFERENCES saved_searches(id) ON DELETE CASCADE,
+    item_id UUID NOT NULL REFERENCES items(id) ON DELETE CASCADE,
+    notified BOOLEAN DEFAULT false,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE(saved_search_id, item_id)
+);
+
+-- Create item_price_history table
+CREATE TABLE IF NOT EXISTS item_price_history (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    item_id UUID NOT NULL REFERENCES items(id) ON DELETE CASCADE,
+    price DECIMAL(10,2) NOT NULL,
+    previous_price DECIMAL(10,2),
+    changed_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Create bundle_items table. A bundle is an item whose listing groups
+-- other items of the same seller.
+CREATE TABLE IF NOT EXISTS bundle_items (
+    bundle_id UUID NOT NULL REFERENCES items(id) ON DELETE CASCADE,
+    item_id UUID NOT NULL REFERENCES items(id) ON DELETE CASCADE,
+    PRIMARY KEY (bundle_id, item_id),
+    CONSTRAINT bundle_not_self CHECK (bundle_id <> item_id)
+);
+
+-- Create multibuy_discounts table
+CREATE TABLE IF NOT EXISTS multibuy_discounts (
+    seller_id UUID PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+    min_items INTEGER NOT NULL,
+    percent_off DECIMAL(5,2) NOT NULL,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    CONSTRAINT multibuy_min_items CHECK (min_items >= 2),
+    CONSTRAINT multibuy_percent_range CHECK (percent_off > 0 AND percent_off <= 90)
+);
+
+-- Create offers table
+CREATE TABLE IF NOT EXISTS offers (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    item_id UUID NOT NULL REFERENCES items(id) ON DELETE CASCADE,
+    buyer_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    amount DECIMAL(10,2) NOT NULL,
+    status offer_status_enum DEFAULT 'pending',
+    last_offer_by UUID NOT NULL REFERENCES users(id),
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    CONSTRAINT offer_amount_positive CHECK (amount > 0)
+);
+
+-- Create free_item_requests table
+CREATE TABLE IF NOT EXISTS free_item_requests (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    item_id UUID NOT NULL REFERENCES items(id) ON DELETE CASCADE,
+    requester_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    address_id UUID NOT NULL REFERENCES addresses(id),
+    message TEXT,
+    status free_request_status_enum DEFAULT 'pending',
+    -- Set once the request is accepted
+    order_id UUID REFERENCES orders(id),
+    decided_at TIMESTAMP WITH TIME ZONE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE(item_id, requester_id)
+);
+
+-- Create auctions table
+CREATE TABLE IF NOT EXISTS auctions (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    item_id UUID NOT NULL REFERENCES items(id) ON DELETE CASCADE,
+    starting_price DECIMAL(10,2) NOT NULL,
+    reserve_price DECIMAL(10,2),
+    bid_increment DECIMAL(10,2) NOT NULL,
+    status auction_status_enum DEFAULT 'open',
+    ends_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    -- The winner's order, set when the auction closes with a sale
+    order_id UUID REFERENCES orders(id),
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    CONSTRAINT auction_prices_positive CHECK (starting_price > 0 AND bid_increment > 0),
+    CONSTRAINT auction_reserve_above_start CHECK (reserve_price IS NULL OR reserve_price >= starting_price)
+);
+
+-- Create auction_bids table
+CREATE TABLE IF NOT EXISTS auction_bids (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    auction_id UUID NOT NULL REFERENCES auctions(id) ON DELETE CASCADE,
+    bidder_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    address_id UUID NOT NULL REFERENCES addresses(id),
+    amount DECIMAL(10,2) NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Create favorites table
+CREATE TABLE IF NOT EXISTS favorites (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    item_id UUID NOT NULL REFERENCES items(id) ON DELETE CASCADE,
+    notify BOOLEAN DEFAULT true,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE(user_id, item_id)
+);
+
+-- Create pickup_locations table
+CREATE TABLE IF NOT EXISTS pickup_locations (
+    user_id UUID PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+    postcode VARCHAR(10) NOT NULL,
+    latitude DOUBLE PRECISION NOT NULL,
+    longitude DOUBLE PRECISION NOT NULL,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Create search_synonyms table
+CREATE TABLE IF NOT EXISTS search_synonyms (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    words TEXT[] NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Create vacation_settings table
+CREATE TABLE IF NOT EXISTS vacation_settings (
+    user_id UUID PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+    starts_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    ends_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    auto_reply TEXT NOT NULL,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    CONSTRAINT chk_vacation_range CHECK (ends_at > starts_at)
+);
+
+-- Create image_moderation_flags table
+CREATE TABLE IF NOT EXISTS image_moderation_flags (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    item_id UUID NOT NULL REFERENCES items(id) ON DELETE CASCADE,
+    image_id UUID NOT NULL REFERENCES item_images(id) ON DELETE CASCADE,
+    matched_item_id UUID NOT NULL REFERENCES items(id) ON DELETE CASCADE,
+    matched_image_id UUID NOT NULL REFERENCES item_images(id) ON DELETE CASCADE,
+    distance INTEGER NOT NULL,
+    status VARCHAR(20) NOT NULL DEFAULT 'pending',
+    resolved_by UUID REFERENCES users(id),
+    resolved_at TIMESTAMP WITH TIME ZONE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE(image_id, matched_image_id),
+    CONSTRAINT chk_moderation_status CHECK (status IN ('pending', 'dismissed', 'confirmed'))
+);
+
 -- Create indexes
 CREATE INDEX IF NOT EXISTS idx_items_seller ON items(seller_id);
 CREATE INDEX IF NOT EXISTS idx_items_category ON items(category);
+CREATE INDEX IF NOT EXISTS idx_items_scheduled ON items(publish_at) WHERE status = 'scheduled';
+CREATE INDEX IF NOT EXISTS idx_items_search ON items USING GIN(search_vector);
+CREATE INDEX IF NOT EXISTS idx_items_search_unmatched ON items(created_at) WHERE search_matched_at IS NULL;
+CREATE INDEX IF NOT EXISTS idx_saved_searches_user ON saved_searches(user_id);
+CREATE INDEX IF NOT EXISTS idx_saved_search_matches_pending ON saved_search_matches(saved_search_id) WHERE NOT notified;
+CREATE INDEX IF NOT EXISTS idx_items_title_trgm ON items USING GIN((title || ' ' || COALESCE(brand, '')) gin_trgm_ops);
+CREATE INDEX IF NOT EXISTS idx_items_deleted_at ON items(deleted_at) WHERE deleted_at IS NOT NULL;
 CREATE INDEX IF NOT EXISTS idx_cart_user ON cart_items(user_id);
+CREATE INDEX IF NOT EXISTS idx_cart_touched ON cart_items(touched_at);
 CREATE INDEX IF NOT EXISTS idx_orders_user ON orders(user_id);
 CREATE INDEX IF NOT EXISTS idx_item_images_item ON item_images(item_id);
+CREATE INDEX IF NOT EXISTS idx_item_images_path ON item_images(image_path);
+CREATE INDEX IF NOT EXISTS idx_item_images_phash_bands ON item_images USING GIN (phash_bands);
+CREATE INDEX IF NOT EXISTS idx_moderation_flags_pending ON image_moderation_flags(created_at) WHERE status = 'pending';
 CREATE INDEX IF NOT EXISTS idx_addresses_user ON addresses(user_id);
 CREATE INDEX IF NOT EXISTS idx_order_items_order ON order_items(order_id);
 CREATE INDEX IF NOT EXISTS idx_order_status_history_order ON order_status_history(order_id);
@@ -138,6 +377,20 @@ CREATE INDEX IF NOT EXISTS idx_message_seen_user ON message_seen(user_id);
 CREATE INDEX IF NOT EXISTS idx_message_seen_message ON message_seen(message_id);
 CREATE INDEX IF NOT EXISTS idx_notifications_user_id ON notifications(user_id);
 CREATE INDEX IF NOT EXISTS idx_notifications_created_at ON notifications(created_at);
+CREATE INDEX IF NOT EXISTS idx_favorites_item ON favorites(item_id);
+CREATE INDEX IF NOT EXISTS idx_bundle_items_item ON bundle_items(item_id);
+CREATE INDEX IF NOT EXISTS idx_trades_proposer ON trades(proposer_id);
+CREATE INDEX IF NOT EXISTS idx_trades_recipient ON trades(recipient_id);
+CREATE INDEX IF NOT EXISTS idx_orders_trade ON orders(trade_id) WHERE trade_id IS NOT NULL;
+CREATE UNIQUE INDEX IF NOT EXISTS idx_offers_open ON offers(item_id, buyer_id) WHERE status IN ('pending', 'accepted');
+CREATE INDEX IF NOT EXISTS idx_offers_buyer ON offers(buyer_id);
+CREATE INDEX IF NOT EXISTS idx_offers_expiry ON offers(expires_at) WHERE status IN ('pending', 'accepted');
+CREATE INDEX IF NOT EXISTS idx_item_price_history_item ON item_price_history(item_id, changed_at);
+CREATE INDEX IF NOT EXISTS idx_free_item_requests_requester ON free_item_requests(requester_id, decided_at) WHERE status = 'accepted';
+CREATE UNIQUE INDEX IF NOT EXISTS idx_auctions_open ON auctions(item_id) WHERE status = 'open';
+CREATE INDEX IF NOT EXISTS idx_auctions_ends_at ON auctions(ends_at) WHERE status = 'open';
+CREATE INDEX IF NOT EXISTS idx_auction_bids_auction ON auction_bids(auction_id, amount DESC);
+CREATE INDEX IF NOT EXISTS idx_items_price_reduced ON items(price_reduced_at) WHERE price_reduced_at IS NOT NULL;
 
 -- Create updated_at trigger function
 CREATE OR REPLACE FUNCTION update_updated_at_column()
@@ -153,3 +406,60 @@ CREATE TRIGGER update_orders_updated_at
     BEFORE UPDATE ON orders
     FOR EACH ROW
     EXECUTE FUNCTION update_updated_at_column();
+
+-- Create trigger for trades table
+CREATE TRIGGER update_trades_updated_at
+    BEFORE UPDATE ON trades
+    FOR EACH ROW
+    EXECUTE FUNCTION update_updated_at_column();
+
+-- Create trigger for offers table
+CREATE TRIGGER update_offers_updated_at
+    BEFORE UPDATE ON offers
+    FOR EACH ROW
+    EXECUTE FUNCTION update_updated_at_column();
+
+-- Price changes are tracked by triggers so every code path that sets a
+-- price, including imports and duplicates, is recorded
+CREATE OR REPLACE FUNCTION mark_item_price_reduced()
+RETURNS TRIGGER AS $$
+BEGIN
+    IF NEW.price < OLD.price THEN
+        NEW.price_reduced_at = CURRENT_TIMESTAMP;
+    ELSIF NEW.price > OLD.price THEN
+        NEW.price_reduced_at = NULL;
+    END IF;
+    RETURN NEW;
+END;
+$$ language 'plpgsql';
+
+CREATE TRIGGER mark_items_price_reduced
+    BEFORE UPDATE OF price ON items
+    FOR EACH ROW
+    EXECUTE FUNCTION mark_item_price_reduced();
+
+CREATE OR REPLACE FUNCTION record_item_price_change()
+RETURNS TRIGGER AS $$
+BEGIN
+    IF TG_OP = 'INSERT' THEN
+        INSERT INTO item_price_history (item_id, price) VALUES (NEW.id, NEW.price);
+    ELSIF NEW.price IS DISTINCT FROM OLD.price THEN
+        INSERT INTO item_price_history (item_id, price, previous_price) VALUES (NEW.id, NEW.price, OLD.price);
+    END IF;
+    RETURN NULL;
+END;
+$$ language 'plpgsql';
+
+CREATE TRIGGER record_items_price_change
+    AFTER INSERT OR UPDATE OF price ON items
+    FOR EACH ROW
+    EXECUTE FUNCTION record_item_price_change();
+
+-- Words used in listing titles and brands, for "did you mean" suggestions.
+-- Refreshed periodically by the server.
+CREATE MATERIALIZED VIEW IF NOT EXISTS search_vocabulary AS
+SELECT word, ndoc
+FROM ts_stat($$SELECT to_tsvector('simple', title || ' ' || COALESCE(brand, '')) FROM items WHERE deleted_at IS NULL$$);
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_search_vocabulary_word ON search_vocabulary(word);
+CREATE INDEX IF NOT EXISTS idx_search_vocabulary_trgm ON search_vocabulary USING GIN(word gin_trgm_ops);
@@ -0,0 +1,450 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"html"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/lib/pq"
+)
+
+var (
+	searchStockKey   = sortKey{"stock", "(CASE WHEN i.quantity > 0 THEN 0 ELSE 1 END)", "int", false}
+	searchCreatedKey = sortKey{"created_at", "i.created_at", "timestamptz", true}
+	searchIDKey      = sortKey{"id", "i.id", "uuid", false}
+)
+
+// Sort orders accepted by the sort parameter of /items/search. Out of stock
+// items always come last and every order ends with the item id, so results
+// sharing a key keep a stable order across pages. The rank expression
+// assumes the text query is the first query parameter.
+var searchSortKeys = map[string][]sortKey{
+	"relevance": {
+		searchStockKey,
+		{"rank", "ts_rank(i.search_vector, to_tsquery('english', $1))", "real", true},
+		searchCreatedKey, searchIDKey,
+	},
+	"newest": {searchStockKey, searchCreatedKey, searchIDKey},
+	"price_asc": {
+		searchStockKey, {"price", "i.price", "numeric", false}, searchCreatedKey, searchIDKey,
+	},
+	"price_desc": {
+		searchStockKey, {"price", "i.price", "numeric", true}, searchCreatedKey, searchIDKey,
+	},
+	// Only valid together with the reduced filter, which excludes NULLs
+	"reduced": {
+		searchStockKey, {"reduced_at", "i.price_reduced_at", "timestamptz", true}, searchCreatedKey, searchIDKey,
+	},
+}
+
+// searchDistanceKeys orders results nearest first. Unlike the other sort
+// orders it depends on the location searched from.
+func searchDistanceKeys(distanceExpr string) []sortKey {
+	return []sortKey{
+		searchStockKey,
+		{"distance", distanceExpr, "double precision", false},
+		searchCreatedKey, searchIDKey,
+	}
+}
+
+// ts_headline returns the listing text as written by the seller, so it marks
+// matches with control characters and highlightSnippet HTML-escapes the text
+// before turning them into <mark> tags. The characters are removed from the
+// text first so a seller cannot place markers of their own.
+const (
+	snippetStartSel = "\x02"
+	snippetStopSel  = "\x03"
+
+	searchHeadlineText    = `translate(COALESCE(NULLIF(i.description, ''), i.title), E'\x02\x03', '')`
+	searchHeadlineOptions = `StartSel="` + snippetStartSel + `", StopSel="` + snippetStopSel + `", MaxFragments=2, MaxWords=20, MinWords=5`
+)
+
+var snippetMarks = strings.NewReplacer(snippetStartSel, "<mark>", snippetStopSel, "</mark>")
+
+// highlightSnippet makes a ts_headline excerpt safe to render as HTML
+func highlightSnippet(headline string) string {
+	return snippetMarks.Replace(html.EscapeString(headline))
+}
+
+// searchWords splits free text into lower case words. Punctuation is
+// dropped since it has meaning in tsquery syntax.
+func searchWords(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// buildSearchTSQuery turns free text into a to_tsquery expression that
+// requires every word, matching each as a prefix so partially typed words
+// still find results. Words with synonyms match any word of their group.
+// Returns "" when the text contains no searchable words.
+func buildSearchTSQuery(text string) string {
+	words := searchWords(text)
+
+	terms := make([]string, 0, len(words))
+	for _, word := range words {
+		group := searchSynonyms.lookup(word)
+		if len(group) == 0 {
+			terms = append(terms, word+":*")
+			continue
+		}
+		alternatives := make([]string, len(group))
+		for i, synonym := range group {
+			alternatives[i] = synonym + ":*"
+		}
+		terms = append(terms, "("+strings.Join(alternatives, " | ")+")")
+	}
+	return strings.Join(terms, " & ")
+}
+
+// searchableItemsSQL restricts a query on items i to listings buyers can see
+const searchableItemsSQL = `i.deleted_at IS NULL
+      AND i.status NOT IN ('draft', 'scheduled', 'paused')` + sellerNotOnVacationSQL
+
+// searchFilter is one condition narrowing a search. Cond contains a single
+// %s where the parameter placeholder goes.
+type searchFilter struct {
+	facet string // facet the filter narrows, or "q" for the text query
+	cond  string
+	arg   interface{}
+}
+
+// searchFiltersFromQuery builds the filters of a search from its query
+// parameters. The text query is always the first filter, so queries that
+// rank results can refer to it as $1.
+func searchFiltersFromQuery(params url.Values) ([]searchFilter, string) {
+	var filters []searchFilter
+
+	tsQuery := buildSearchTSQuery(params.Get("q"))
+	if tsQuery != "" {
+		filters = append(filters, searchFilter{"q", "i.search_vector @@ to_tsquery('english', %s)", tsQuery})
+	}
+
+	if category := params.Get("category"); category != "" {
+		filters = append(filters, searchFilter{"category", "i.category = %s", category})
+	}
+
+	if size := params.Get("size"); size != "" {
+		filters = append(filters, searchFilter{"size", "i.size = %s", size})
+	}
+
+	if condition := params.Get("condition"); condition != "" {
+		filters = append(filters, searchFilter{"condition", "i.condition = %s", condition})
+	}
+
+	if sellerID := params.Get("seller_id"); sellerID != "" {
+		filters = append(filters, searchFilter{"seller", "i.seller_id = %s", sellerID})
+	}
+
+	if minPrice := params.Get("min_price"); minPrice != "" {
+		filters = append(filters, searchFilter{"price", "i.price >= %s", minPrice})
+	}
+
+	if maxPrice := params.Get("max_price"); maxPrice != "" {
+		filters = append(filters, searchFilter{"price", "i.price <= %s", maxPrice})
+	}
+
+	if params.Get("free") == "true" {
+		filters = append(filters, searchFilter{"free", "i.is_free = %s", true})
+	}
+
+	// Sorting by reduction implies the filter
+	if params.Get("reduced") == "true" || params.Get("sort") == "reduced" {
+		filters = append(filters, searchFilter{"reduced", "i.price_reduced_at > %s", time.Now().Add(-recentlyReducedPeriod)})
+	}
+
+	return filters, tsQuery
+}
+
+// searchOriginFromQuery resolves the near parameter of a search to the
+// coordinates of the postcode and returns the radius to search within.
+// The origin is nil when the search is not restricted by distance.
+func searchOriginFromQuery(params url.Values) (*coordinates, float64, error) {
+	near := params.Get("near")
+	radius := params.Get("radius_km")
+	if near == "" {
+		if radius != "" {
+			return nil, 0, fmt.Errorf("radius_km requires near")
+		}
+		return nil, 0, nil
+	}
+
+	origin, ok := lookupPostcode(near)
+	if !ok {
+		return nil, 0, fmt.Errorf("unknown postcode: %q", near)
+	}
+
+	radiusKm := float64(defaultPickupRadiusKm)
+	if radius != "" {
+		var err error
+		radiusKm, err = strconv.ParseFloat(radius, 64)
+		if err != nil || radiusKm <= 0 || radiusKm > maxPickupRadiusKm {
+			return nil, 0, fmt.Errorf("radius_km must be between 0 and %d", maxPickupRadiusKm)
+		}
+	}
+	return &origin, radiusKm, nil
+}
+
+// searchDistanceFilter restricts a search to listings that can be collected
+// within radiusKm of origin
+func searchDistanceFilter(origin coordinates, radiusKm float64) searchFilter {
+	return searchFilter{"distance", "i.local_pickup AND " + distanceKmSQL(origin) + " <= %s", radiusKm}
+}
+
+// searchFilterSQL joins the filters into " AND ..." conditions numbered
+// from $1, leaving out those narrowing the excluded facet.
+func searchFilterSQL(filters []searchFilter, exclude string) (string, []interface{}) {
+	var conds string
+	var args []interface{}
+	for _, f := range filters {
+		if exclude != "" && f.facet == exclude {
+			continue
+		}
+		args = append(args, f.arg)
+		conds += " AND " + fmt.Sprintf(f.cond, fmt.Sprintf("$%d", len(args)))
+	}
+	return conds, args
+}
+
+// SearchPage is a page of search results with optional facet counts and
+// a spelling suggestion
+type SearchPage struct {
+	Page
+	Facets     *SearchFacets `json:"facets,omitempty"`
+	DidYouMean string        `json:"did_you_mean,omitempty"`
+}
+
+type FacetCount struct {
+	Value string `json:"value"`
+	Label string `json:"label,omitempty"`
+	Count int    `json:"count"`
+}
+
+// SearchFacets counts matching listings per filter option. Each facet
+// ignores its own filter so the other options stay visible after one is
+// picked; empty options are left out.
+type SearchFacets struct {
+	Category  []FacetCount `json:"category"`
+	Size      []FacetCount `json:"size"`
+	Price     []FacetCount `json:"price"`
+	Seller    []FacetCount `json:"seller"`
+	Condition []FacetCount `json:"condition"`
+}
+
+const maxSellerFacets = 20
+
+// Price buckets as [min, max) ranges; a max of 0 means no upper bound.
+// Values are "min-max" so the client can turn them into price filters.
+var searchPriceBuckets = []struct{ min, max float64 }{
+	{0, 10}, {10, 25}, {25, 50}, {50, 100}, {100, 0},
+}
+
+func priceBucketSQL() string {
+	sql := "CASE"
+	for _, b := range searchPriceBuckets {
+		value := fmt.Sprintf("%g-", b.min)
+		if b.max > 0 {
+			value += fmt.Sprintf("%g", b.max)
+			sql += fmt.Sprintf(" WHEN i.price < %g THEN '%s'", b.max, value)
+		} else {
+			sql += fmt.Sprintf(" ELSE '%s'", value)
+		}
+	}
+	return sql + " END"
+}
+
+func searchFacets(filters []searchFilter) (*SearchFacets, error) {
+	var facets SearchFacets
+	var err error
+
+	// Enum columns sort in declaration order, which is how sizes and
+	// conditions are presented
+	queries := []struct {
+		facet string
+		dest  *[]FacetCount
+		query string
+	}{
+		{"category", &facets.Category, `
+			SELECT i.category::text, '', COUNT(*) FROM items i
+			WHERE %s GROUP BY i.category ORDER BY COUNT(*) DESC, i.category`},
+		{"size", &facets.Size, `
+			SELECT i.size::text, '', COUNT(*) FROM items i
+			WHERE %s GROUP BY i.size ORDER BY i.size`},
+		{"price", &facets.Price, `
+			SELECT ` + priceBucketSQL() + ` AS bucket, '', COUNT(*) FROM items i
+			WHERE %s GROUP BY bucket ORDER BY MIN(i.price)`},
+		{"seller", &facets.Seller, `
+			SELECT i.seller_id::text, u.name, COUNT(*) FROM items i
+			JOIN users u ON i.seller_id = u.id
+			WHERE %s GROUP BY i.seller_id, u.name ORDER BY COUNT(*) DESC, u.name
+			LIMIT ` + strconv.Itoa(maxSellerFacets)},
+		{"condition", &facets.Condition, `
+			SELECT i.condition::text, '', COUNT(*) FROM items i
+			WHERE %s AND i.condition IS NOT NULL GROUP BY i.condition ORDER BY i.condition`},
+	}
+
+	for _, q := range queries {
+		conds, args := searchFilterSQL(filters, q.facet)
+		*q.dest, err = queryFacetCounts(fmt.Sprintf(q.query, searchableItemsSQL+conds), args)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &facets, nil
+}
+
+func queryFacetCounts(query string, args []interface{}) ([]FacetCount, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := make([]FacetCount, 0)
+	for rows.Next() {
+		var c FacetCount
+		if err := rows.Scan(&c.Value, &c.Label, &c.Count); err != nil {
+			return nil, err
+		}
+		counts = append(counts, c)
+	}
+	return counts, rows.Err()
+}
+
+// searchItemColumns are the columns scanned by scanSearchItems, selected
+// from items i joined with item_images im and users u, grouped by item.
+// Queries add rank, snippet and distance columns after them.
+const searchItemColumns = `i.id, i.title, i.description, COALESCE(i.brand, ''), i.price, i.size, i.category,
+             COALESCE(i.condition::text, ''), i.local_pickup, i.status, i.quantity, i.seller_id, u.name as seller_name,
+             i.created_at, i.price_reduced_at, ` + favoritesCountSQL + `, i.is_free, ` + itemImagesSQL
+
+func scanSearchItems(rows *sql.Rows) ([]Item, []float32, error) {
+	defer rows.Close()
+
+	items := make([]Item, 0)
+	var ranks []float32
+	for rows.Next() {
+		var item Item
+		var images, imageIDs []sql.NullString
+		var rank float32
+		var distance sql.NullFloat64
+		err := rows.Scan(
+			&item.ID, &item.Title, &item.Description, &item.Brand, &item.Price,
+			&item.Size, &item.Category, &item.Condition, &item.LocalPickup, &item.Status, &item.Quantity,
+			&item.SellerID, &item.SellerName, &item.CreatedAt, &item.PriceReducedAt, &item.FavoritesCount, &item.Free, pq.Array(&images), pq.Array(&imageIDs),
+			&rank, &item.Snippet, &distance)
+		if err != nil {
+			return nil, nil, err
+		}
+		if distance.Valid {
+			item.DistanceKm = &distance.Float64
+		}
+		item.Snippet = highlightSnippet(item.Snippet)
+
+		setItemImages(&item, images, imageIDs)
+
+		items = append(items, item)
+		ranks = append(ranks, rank)
+	}
+	return items, ranks, rows.Err()
+}
+
+// Searches with fewer exact matches than this on their first page are
+// topped up with fuzzy matches
+const fuzzySearchThreshold = 5
+
+// searchTrigramText is the indexed text that fuzzy search compares the
+// query against
+const searchTrigramText = `(i.title || ' ' || COALESCE(i.brand, ''))`
+
+// fuzzySearchItems finds up to limit listings whose title or brand is
+// spelled similarly to the query, for searches where exact word matching
+// found little. Listings already in exact are skipped.
+func fuzzySearchItems(query string, filters []searchFilter, distanceSelect string, exact []Item, limit int) ([]Item, error) {
+	if limit <= 0 {
+		return nil, nil
+	}
+
+	exclude := make([]string, len(exact))
+	for i, item := range exact {
+		exclude[i] = item.ID
+	}
+
+	filterSQL, args := searchFilterSQL(filters, "q")
+	n := len(args)
+	args = append(args, query, pq.Array(exclude))
+
+	rows, err := db.Query(fmt.Sprintf(`
+      SELECT `+searchItemColumns+`,
+             word_similarity($%d, `+searchTrigramText+`)::real as rank, '' as snippet,
+             `+distanceSelect+`
+      FROM items i
+      LEFT JOIN item_images im ON i.id = im.item_id
+      JOIN users u ON i.seller_id = u.id
+      WHERE `+searchableItemsSQL+filterSQL+`
+      AND $%d <%% `+searchTrigramText+`
+      AND NOT (i.id = ANY($%d))
+      GROUP BY i.id, u.name
+      ORDER BY (CASE WHEN i.quantity > 0 THEN 0 ELSE 1 END), rank DESC, i.created_at DESC, i.id
+      LIMIT %d`, n+1, n+1, n+2, limit),
+		args...)
+	if err != nil {
+		return nil, err
+	}
+
+	items, _, err := scanSearchItems(rows)
+	for i := range items {
+		items[i].FuzzyMatch = true
+	}
+	return items, err
+}
+
+// didYouMean suggests a corrected query by replacing each word that does
+// not occur in any listing with the most similar word that does. Returns
+// "" when there is nothing to correct.
+func didYouMean(query string) (string, error) {
+	words := searchWords(query)
+	changed := false
+	for i, word := range words {
+		if len(searchSynonyms.lookup(word)) > 0 {
+			continue
+		}
+
+		// Prefixes of known words are fine since every word matches as a
+		// prefix; otherwise take the closest known spelling
+		var suggestion string
+		err := db.QueryRow(`
+			SELECT CASE WHEN EXISTS (SELECT 1 FROM search_vocabulary WHERE word LIKE $1 || '%')
+						THEN $1
+						ELSE COALESCE((SELECT word FROM search_vocabulary
+									   WHERE word % $1
+									   ORDER BY similarity(word, $1) DESC, ndoc DESC
+									   LIMIT 1), $1)
+				   END`,
+			word).Scan(&suggestion)
+		if err != nil {
+			return "", err
+		}
+		if suggestion != word {
+			words[i] = suggestion
+			changed = true
+		}
+	}
+
+	if !changed {
+		return "", nil
+	}
+	return strings.Join(words, " "), nil
+}
+
+// refreshSearchVocabulary rebuilds the list of words used by listings that
+// didYouMean picks corrections from.
+func refreshSearchVocabulary() error {
+	_, err := db.Exec(`REFRESH MATERIALIZED VIEW CONCURRENTLY search_vocabulary`)
+	return err
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultSuggestions = 8
+	maxSuggestions     = 20
+)
+
+type Suggestion struct {
+	Text string `json:"text"`
+	Type string `json:"type"` // title, brand or category
+}
+
+type suggestionEntry struct {
+	Suggestion
+	score int
+}
+
+// suggestionKey indexes a suggestion under one of its word boundaries so
+// "snow" completes "Winter snowsuit" as well as "Snowsuit".
+type suggestionKey struct {
+	prefix string
+	entry  *suggestionEntry
+}
+
+// suggestionCache holds every completion in memory, sorted by key, so a
+// keystroke costs a binary search rather than a query. It is rebuilt
+// periodically from the live listings.
+type suggestionCache struct {
+	mu   sync.RWMutex
+	keys []suggestionKey
+}
+
+var suggestions = &suggestionCache{}
+
+func (c *suggestionCache) lookup(prefix string, limit int) []Suggestion {
+	c.mu.RLock()
+	keys := c.keys
+	c.mu.RUnlock()
+
+	start := sort.Search(len(keys), func(i int) bool { return keys[i].prefix >= prefix })
+
+	seen := make(map[*suggestionEntry]bool)
+	var matches []*suggestionEntry
+	for i := start; i < len(keys) && strings.HasPrefix(keys[i].prefix, prefix); i++ {
+		if !seen[keys[i].entry] {
+			seen[keys[i].entry] = true
+			matches = append(matches, keys[i].entry)
+		}
+	}
+
+	sort.SliceStable(matches, func(a, b int) bool {
+		if matches[a].score != matches[b].score {
+			return matches[a].score > matches[b].score
+		}
+		return matches[a].Text < matches[b].Text
+	})
+
+	result := make([]Suggestion, 0, limit)
+	for _, m := range matches {
+		if len(result) == limit {
+			break
+		}
+		result = append(result, m.Suggestion)
+	}
+	return result
+}
+
+// refresh rebuilds the cache. A listing's popularity counts its orders
+// three times and cart adds once, plus one for being listed at all, and a
+// brand or category is as popular as all of its listings together.
+func (c *suggestionCache) refresh() error {
+	rows, err := db.Query(`
+		SELECT i.title, COALESCE(i.brand, ''), i.category,
+			   1 + 3 * (SELECT COUNT(*) FROM order_items oi WHERE oi.item_id = i.id)
+				 + (SELECT COUNT(*) FROM cart_items c WHERE c.item_id = i.id)
+		FROM items i
+		WHERE ` + searchableItemsSQL)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	entries := make(map[string]*suggestionEntry)
+	add := func(kind, text string, score int) {
+		text = strings.Join(strings.Fields(text), " ")
+		if text == "" {
+			return
+		}
+		id := kind + ":" + strings.ToLower(text)
+		if e, ok := entries[id]; ok {
+			e.score += score
+			return
+		}
+		entries[id] = &suggestionEntry{Suggestion{Text: text, Type: kind}, score}
+	}
+
+	for rows.Next() {
+		var title, brand, category string
+		var score int
+		if err := rows.Scan(&title, &brand, &category, &score); err != nil {
+			return err
+		}
+		add("title", title, score)
+		add("brand", brand, score)
+		add("category", category, score)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	var keys []suggestionKey
+	for _, e := range entries {
+		words := strings.Fields(strings.ToLower(e.Text))
+		for i := range words {
+			keys = append(keys, suggestionKey{strings.Join(words[i:], " "), e})
+		}
+	}
+	sort.Slice(keys, func(a, b int) bool { return keys[a].prefix < keys[b].prefix })
+
+	c.mu.Lock()
+	c.keys = keys
+	c.mu.Unlock()
+	return nil
+}
+
+func suggestHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	prefix := strings.Join(strings.Fields(strings.ToLower(r.URL.Query().Get("q"))), " ")
+	if prefix == "" {
+		sendJSON(w, []Suggestion{})
+		return
+	}
+
+	limit := defaultSuggestions
+	if l := r.URL.Query().Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n < 1 {
+			http.Error(w, "limit must be a positive integer", http.StatusBadRequest)
+			return
+		}
+		if n > maxSuggestions {
+			n = maxSuggestions
+		}
+		limit = n
+	}
+
+	// Completions change slowly; let the browser reuse them while typing
+	w.Header().Set("Cache-Control", "public, max-age=60")
+	sendJSON(w, suggestions.lookup(prefix, limit))
+}
+
+// startSuggestionCache fills the suggestion cache and keeps it current
+func startSuggestionCache(interval time.Duration) {
+	if err := suggestions.refresh(); err != nil {
+		log.Printf("Error building search suggestions: %v", err)
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := suggestions.refresh(); err != nil {
+			log.Printf("Error building search suggestions: %v", err)
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// SynonymGroup is a set of words buyers use for the same thing, e.g.
+// onesie, babygrow and romper. Searching for any of them finds all.
+type SynonymGroup struct {
+	ID        string    `json:"id"`
+	Words     []string  `json:"words"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// synonymDictionary is the in-memory copy of search_synonyms consulted on
+// every search. It is reloaded whenever an admin edits the dictionary and
+// periodically to pick up edits made through other instances.
+type synonymDictionary struct {
+	mu     sync.RWMutex
+	byWord map[string][]string
+}
+
+var searchSynonyms = &synonymDictionary{}
+
+// lookup returns every word equivalent to word, including itself, or nil
+// if it has no synonyms.
+func (d *synonymDictionary) lookup(word string) []string {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.byWord[word]
+}
+
+func (d *synonymDictionary) load() error {
+	rows, err := db.Query(`SELECT words FROM search_synonyms`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	// A word listed in several groups is equivalent to all of their words
+	byWord := make(map[string][]string)
+	seen := make(map[string]map[string]bool)
+	for rows.Next() {
+		var words []string
+		if err := rows.Scan(pq.Array(&words)); err != nil {
+			return err
+		}
+		for _, word := range words {
+			if seen[word] == nil {
+				seen[word] = make(map[string]bool)
+			}
+			for _, synonym := range words {
+				if !seen[word][synonym] {
+					seen[word][synonym] = true
+					byWord[word] = append(byWord[word], synonym)
+				}
+			}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	d.byWord = byWord
+	d.mu.Unlock()
+	return nil
+}
+
+// normalizeSynonymWords lower-cases and deduplicates a group. Only single
+// words are accepted since synonyms replace individual query words.
+func normalizeSynonymWords(words []string) ([]string, error) {
+	var normalized []string
+	seen := make(map[string]bool)
+	for _, word := range words {
+		parts := searchWords(word)
+		if len(parts) != 1 {
+			return nil, fmt.Errorf("invalid synonym %q: must be a single word", word)
+		}
+		if !seen[parts[0]] {
+			seen[parts[0]] = true
+			normalized = append(normalized, parts[0])
+		}
+	}
+	if len(normalized) < 2 {
+		return nil, fmt.Errorf("a synonym group needs at least two different words")
+	}
+	return normalized, nil
+}
+
+func synonymsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		rows, err := db.Query(`SELECT id, words, created_at FROM search_synonyms ORDER BY words[1]`)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		groups := make([]SynonymGroup, 0)
+		for rows.Next() {
+			var g SynonymGroup
+			if err := rows.Scan(&g.ID, pq.Array(&g.Words), &g.CreatedAt); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			groups = append(groups, g)
+		}
+
+		sendJSON(w, groups)
+
+	case http.MethodPost, http.MethodPut:
+		var g SynonymGroup
+		if err := json.NewDecoder(r.Body).Decode(&g); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		words, err := normalizeSynonymWords(g.Words)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		g.Words = words
+
+		if r.Method == http.MethodPost {
+			err = db.QueryRow(`
+				INSERT INTO search_synonyms (words) VALUES ($1)
+				RETURNING id, created_at`,
+				pq.Array(g.Words)).Scan(&g.ID, &g.CreatedAt)
+		} else {
+			err = db.QueryRow(`
+				UPDATE search_synonyms SET words = $1, updated_at = CURRENT_TIMESTAMP
+				WHERE id = $2
+				RETURNING id, created_at`,
+				pq.Array(g.Words), r.URL.Query().Get("id")).Scan(&g.ID, &g.CreatedAt)
+		}
+
+		if err == sql.ErrNoRows {
+			http.Error(w, "Synonym group not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if err := searchSynonyms.load(); err != nil {
+			log.Printf("Error reloading search synonyms: %v", err)
+		}
+		sendJSON(w, g)
+
+	case http.MethodDelete:
+		result, err := db.Exec(`DELETE FROM search_synonyms WHERE id = $1`, r.URL.Query().Get("id"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			http.Error(w, "Synonym group not found", http.StatusNotFound)
+			return
+		}
+
+		if err := searchSynonyms.load(); err != nil {
+			log.Printf("Error reloading search synonyms: %v", err)
+		}
+		w.WriteHeader(http.StatusOK)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// startSearchDictionaryRefresher periodically reloads the synonyms and
+// rebuilds the vocabulary behind "did you mean" suggestions.
+func startSearchDictionaryRefresher(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := searchSynonyms.load(); err != nil {
+			log.Printf("Error reloading search synonyms: %v", err)
+		}
+		if err := refreshSearchVocabulary(); err != nil {
+			log.Printf("Error refreshing search vocabulary: %v", err)
+		}
+	}
+}
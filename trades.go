@@ -0,0 +1,603 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+const maxTradeItemsPerSide = 10
+
+// Trade is a proposal to swap items between two users. Once both sides
+// agree, each side gets a zero-price order for the items it receives,
+// so shipping, status updates and messages work as for any other order.
+type Trade struct {
+	ID               string      `json:"id"`
+	ProposerID       string      `json:"proposer_id"`
+	RecipientID      string      `json:"recipient_id"`
+	Status           string      `json:"status"`
+	Message          string      `json:"message,omitempty"`
+	OfferedItems     []TradeItem `json:"offered_items"`
+	RequestedItems   []TradeItem `json:"requested_items"`
+	ProposerOrderID  string      `json:"proposer_order_id,omitempty"`
+	RecipientOrderID string      `json:"recipient_order_id,omitempty"`
+	CreatedAt        time.Time   `json:"created_at"`
+	UpdatedAt        time.Time   `json:"updated_at"`
+}
+
+type TradeItem struct {
+	ID    string  `json:"id"`
+	Title string  `json:"title"`
+	Price float64 `json:"price"`
+}
+
+// parseTradeItemIDs checks and deduplicates the item ids of one side
+func parseTradeItemIDs(ids []string, side string) ([]string, error) {
+	seen := make(map[string]bool)
+	var unique []string
+	for _, id := range ids {
+		if _, err := uuid.Parse(id); err != nil {
+			return nil, fmt.Errorf("invalid %s item id: %q", side, id)
+		}
+		if !seen[id] {
+			seen[id] = true
+			unique = append(unique, id)
+		}
+	}
+	if len(unique) == 0 || len(unique) > maxTradeItemsPerSide {
+		return nil, fmt.Errorf("a trade needs between 1 and %d %s items", maxTradeItemsPerSide, side)
+	}
+	return unique, nil
+}
+
+// ownsAddress reports whether addressID is one of the user's addresses
+// that has not been deleted
+func ownsAddress(q queryRower, userID, addressID string) (bool, error) {
+	if _, err := uuid.Parse(addressID); err != nil {
+		return false, nil
+	}
+	var exists bool
+	err := q.QueryRow(`
+		SELECT EXISTS (
+			SELECT 1 FROM addresses
+			WHERE id = $1 AND user_id = $2
+			AND deleted_at IS NULL)`,
+		addressID, userID).Scan(&exists)
+	return exists, err
+}
+
+func tradesHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		listTrades(w, r)
+	case http.MethodPost:
+		proposeTrade(w, r)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// loadTrade reads a trade the user takes part in, with its items
+func loadTrade(q interface {
+	queryRower
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}, tradeID, userID string) (Trade, error) {
+	var t Trade
+	var proposerOrderID, recipientOrderID sql.NullString
+	err := q.QueryRow(`
+		SELECT t.id, t.proposer_id, t.recipient_id, t.status, COALESCE(t.message, ''),
+			   (SELECT o.id::text FROM orders o WHERE o.trade_id = t.id AND o.user_id = t.proposer_id),
+			   (SELECT o.id::text FROM orders o WHERE o.trade_id = t.id AND o.user_id = t.recipient_id),
+			   t.created_at, t.updated_at
+		FROM trades t
+		WHERE t.id = $1 AND (t.proposer_id = $2 OR t.recipient_id = $2)`,
+		tradeID, userID).Scan(&t.ID, &t.ProposerID, &t.RecipientID, &t.Status, &t.Message,
+		&proposerOrderID, &recipientOrderID, &t.CreatedAt, &t.UpdatedAt)
+	if err != nil {
+		return t, err
+	}
+	t.ProposerOrderID = proposerOrderID.String
+	t.RecipientOrderID = recipientOrderID.String
+
+	rows, err := q.Query(`
+		SELECT i.id, i.title, i.price, i.seller_id = $2
+		FROM trade_items ti
+		JOIN items i ON ti.item_id = i.id
+		WHERE ti.trade_id = $1
+		ORDER BY i.title`,
+		t.ID, t.ProposerID)
+	if err != nil {
+		return t, err
+	}
+	defer rows.Close()
+
+	t.OfferedItems = make([]TradeItem, 0)
+	t.RequestedItems = make([]TradeItem, 0)
+	for rows.Next() {
+		var item TradeItem
+		var offered bool
+		if err := rows.Scan(&item.ID, &item.Title, &item.Price, &offered); err != nil {
+			return t, err
+		}
+		if offered {
+			t.OfferedItems = append(t.OfferedItems, item)
+		} else {
+			t.RequestedItems = append(t.RequestedItems, item)
+		}
+	}
+	return t, rows.Err()
+}
+
+// listTrades returns the trades the user proposed or received, newest
+// first, optionally narrowed to one ?status
+func listTrades(w http.ResponseWriter, r *http.Request) {
+	userID, _ := getUserIDFromContext(r.Context())
+
+	keys := newestFirstKeys("t")
+	page, err := parsePageRequest(r, "trades", keys)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	filter := "(t.proposer_id = $1 OR t.recipient_id = $1)"
+	args := []interface{}{userID}
+	if status := r.URL.Query().Get("status"); status != "" {
+		args = append(args, status)
+		filter += fmt.Sprintf(" AND t.status::text = $%d", len(args))
+	}
+
+	total, err := page.countTotal(`SELECT COUNT(*) FROM trades t WHERE `+filter, args...)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if cond, pageArgs := page.where(keys, len(args)+1); cond != "" {
+		filter += " AND " + cond
+		args = append(args, pageArgs...)
+	}
+
+	rows, err := db.Query(`
+		SELECT t.id FROM trades t
+		WHERE `+filter+`
+		ORDER BY `+orderByKeys(keys)+page.limitClause(),
+		args...)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+
+	trades := make([]Trade, 0, len(ids))
+	for _, id := range ids {
+		t, err := loadTrade(db, id, userID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		trades = append(trades, t)
+	}
+
+	result := Page{Total: total}
+	if page.hasMore(len(trades)) {
+		trades = trades[:page.limit]
+		last := trades[len(trades)-1]
+		result.NextCursor = page.nextCursor(keys, createdAtCursorValues(last.CreatedAt, last.ID))
+	}
+	result.Items = trades
+
+	sendJSON(w, result)
+}
+
+// proposeTrade offers some of the user's items for items of one other
+// user. The proposer picks the address their side should be shipped to.
+func proposeTrade(w http.ResponseWriter, r *http.Request) {
+	userID, _ := getUserIDFromContext(r.Context())
+
+	var req struct {
+		OfferedItemIDs   []string `json:"offered_item_ids"`
+		RequestedItemIDs []string `json:"requested_item_ids"`
+		AddressID        string   `json:"address_id"`
+		Message          string   `json:"message"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	offered, err := parseTradeItemIDs(req.OfferedItemIDs, "offered")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	requested, err := parseTradeItemIDs(req.RequestedItemIDs, "requested")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ok, err := ownsAddress(db, userID, req.AddressID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		http.Error(w, "address_id must be one of your addresses", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var offeredCount int
+	err = tx.QueryRow(`
+		SELECT COUNT(*) FROM items
+		WHERE id = ANY($1) AND seller_id = $2
+		AND status = 'available' AND quantity > 0 AND deleted_at IS NULL`,
+		pq.Array(offered), userID).Scan(&offeredCount)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if offeredCount != len(offered) {
+		http.Error(w, "Offered items must be your own available listings", http.StatusBadRequest)
+		return
+	}
+
+	// All requested items must come from the same other user
+	var recipientIDs []string
+	var requestedCount int
+	err = tx.QueryRow(`
+		SELECT array_agg(DISTINCT seller_id::text), COUNT(*) FROM items
+		WHERE id = ANY($1) AND status = 'available' AND quantity > 0 AND deleted_at IS NULL`,
+		pq.Array(requested)).Scan(pq.Array(&recipientIDs), &requestedCount)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if requestedCount != len(requested) {
+		http.Error(w, "Requested items not found or unavailable", http.StatusBadRequest)
+		return
+	}
+	if len(recipientIDs) != 1 || recipientIDs[0] == userID {
+		http.Error(w, "Requested items must all belong to one other user", http.StatusBadRequest)
+		return
+	}
+	recipientID := recipientIDs[0]
+
+	auctioned, err := anyInOpenAuction(tx, append(append([]string{}, offered...), requested...))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if auctioned {
+		http.Error(w, "Items being auctioned cannot be swapped", http.StatusBadRequest)
+		return
+	}
+
+	vacation, err := getActiveVacation(tx, recipientID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if vacation != nil {
+		http.Error(w, fmt.Sprintf("Seller is on vacation until %s", vacation.EndsAt.Format("2 January 2006")), http.StatusBadRequest)
+		return
+	}
+
+	var tradeID string
+	err = tx.QueryRow(`
+		INSERT INTO trades (proposer_id, recipient_id, proposer_address_id, message)
+		VALUES ($1, $2, $3, NULLIF($4, ''))
+		RETURNING id`,
+		userID, recipientID, req.AddressID, req.Message).Scan(&tradeID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO trade_items (trade_id, item_id)
+		SELECT $1, unnest($2::uuid[])`,
+		tradeID, pq.Array(append(offered, requested...)))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = createNotification(tx, recipientID, "trade", tradeID,
+		fmt.Sprintf("New swap proposal: %d of their items for %d of yours", len(offered), len(requested)))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	trade, err := loadTrade(tx, tradeID, userID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err = tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	sendJSON(w, trade)
+}
+
+// respondToTradeHandler lets the recipient accept or decline a proposal
+// and the proposer withdraw it. Accepting requires the address the
+// recipient's side should be shipped to.
+func respondToTradeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, _ := getUserIDFromContext(r.Context())
+	tradeID := r.URL.Query().Get("id")
+
+	var req struct {
+		Action    string `json:"action"`
+		AddressID string `json:"address_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var proposerID, recipientID, proposerAddressID, status string
+	err = tx.QueryRow(`
+		SELECT proposer_id, recipient_id, proposer_address_id, status
+		FROM trades
+		WHERE id = $1 AND (proposer_id = $2 OR recipient_id = $2)
+		FOR UPDATE`,
+		tradeID, userID).Scan(&proposerID, &recipientID, &proposerAddressID, &status)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Trade not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if status != "proposed" {
+		http.Error(w, "Trade is no longer open", http.StatusBadRequest)
+		return
+	}
+
+	var newStatus, notifyID, message string
+	switch req.Action {
+	case "accept", "decline":
+		if userID != recipientID {
+			http.Error(w, "Only the recipient can accept or decline a trade", http.StatusForbidden)
+			return
+		}
+		newStatus, notifyID = "declined", proposerID
+		message = "Your swap proposal was declined"
+	case "withdraw":
+		if userID != proposerID {
+			http.Error(w, "Only the proposer can withdraw a trade", http.StatusForbidden)
+			return
+		}
+		newStatus, notifyID = "withdrawn", recipientID
+		message = "A swap proposal to you was withdrawn"
+	default:
+		http.Error(w, "action must be accept, decline or withdraw", http.StatusBadRequest)
+		return
+	}
+
+	if req.Action == "accept" {
+		ok, err := ownsAddress(tx, userID, req.AddressID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			http.Error(w, "address_id must be one of your addresses", http.StatusBadRequest)
+			return
+		}
+
+		unavailable, err := createTradeOrders(tx, tradeID, proposerID, recipientID, proposerAddressID, req.AddressID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if unavailable {
+			http.Error(w, "Some items of this trade are no longer available", http.StatusConflict)
+			return
+		}
+		newStatus = "accepted"
+		message = "Your swap proposal was accepted. Ship your items through the new order"
+	}
+
+	_, err = tx.Exec(`UPDATE trades SET status = $1::trade_status_enum WHERE id = $2`, newStatus, tradeID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := createNotification(tx, notifyID, "trade", tradeID, message); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	trade, err := loadTrade(tx, tradeID, userID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err = tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	sendJSON(w, trade)
+}
+
+// createTradeOrders creates one zero-price order per side for the items it
+// receives and takes all traded items out of stock. It reports whether an
+// item was sold or withdrawn since the trade was proposed.
+func createTradeOrders(tx *sql.Tx, tradeID, proposerID, recipientID, proposerAddressID, recipientAddressID string) (bool, error) {
+	rows, err := tx.Query(`
+		SELECT i.id, i.status = 'available' AND i.quantity > 0 AND i.deleted_at IS NULL
+		FROM trade_items ti
+		JOIN items i ON ti.item_id = i.id
+		WHERE ti.trade_id = $1
+		FOR UPDATE OF i`,
+		tradeID)
+	if err != nil {
+		return false, err
+	}
+	var itemIDs []string
+	var unavailable bool
+	for rows.Next() {
+		var itemID string
+		var available bool
+		if err := rows.Scan(&itemID, &available); err != nil {
+			rows.Close()
+			return false, err
+		}
+		itemIDs = append(itemIDs, itemID)
+		unavailable = unavailable || !available
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil || unavailable {
+		return unavailable, err
+	}
+
+	// An auction may have started on an item since the trade was proposed
+	auctioned, err := anyInOpenAuction(tx, itemIDs)
+	if err != nil || auctioned {
+		return auctioned, err
+	}
+
+	sides := []struct{ buyerID, sellerID, addressID string }{
+		{proposerID, recipientID, proposerAddressID},
+		{recipientID, proposerID, recipientAddressID},
+	}
+	for _, side := range sides {
+		var orderID string
+		err := tx.QueryRow(`
+			INSERT INTO orders (user_id, address_id, total, status, trade_id)
+			VALUES ($1, $2, 0, 'pending', $3)
+			RETURNING id`,
+			side.buyerID, side.addressID, tradeID).Scan(&orderID)
+		if err != nil {
+			return false, err
+		}
+
+		_, err = tx.Exec(`
+			INSERT INTO order_items (order_id, item_id, price_at_time)
+			SELECT $1, i.id, 0
+			FROM trade_items ti
+			JOIN items i ON ti.item_id = i.id
+			WHERE ti.trade_id = $2 AND i.seller_id = $3`,
+			orderID, tradeID, side.sellerID)
+		if err != nil {
+			return false, err
+		}
+
+		_, err = tx.Exec(`
+			UPDATE items i
+			SET quantity = quantity - 1,
+				status = CASE
+						WHEN quantity - 1 <= 0 THEN 'sold'::item_status_enum
+						ELSE status
+				END
+			FROM order_items oi
+			WHERE oi.item_id = i.id AND oi.order_id = $1`,
+			orderID)
+		if err != nil {
+			return false, err
+		}
+
+		if err := sellBundleStock(tx, orderID); err != nil {
+			return false, err
+		}
+
+		err = createNotification(tx, side.sellerID, "order_status", orderID,
+			fmt.Sprintf("New swap order #%s received", orderID))
+		if err != nil {
+			return false, err
+		}
+	}
+
+	return false, nil
+}
+
+// cancelTradePartnerOrder cancels the other order of a swap when one side
+// is cancelled, so neither user keeps the items they received while their
+// own are returned. Once the other side has shipped the swap can no longer
+// be called off, which is reported as an error meant for the user.
+func cancelTradePartnerOrder(tx *sql.Tx, tradeID, orderID, reason string) (userErr string, err error) {
+	var partnerID, partnerBuyerID, partnerStatus string
+	var restocked bool
+	err = tx.QueryRow(`
+		SELECT id, user_id, status, restocked FROM orders
+		WHERE trade_id = $1 AND id <> $2`,
+		tradeID, orderID).Scan(&partnerID, &partnerBuyerID, &partnerStatus, &restocked)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	switch partnerStatus {
+	case "cancelled":
+		return "", nil
+	case "shipped", "delivered":
+		return "The other side of this swap has already shipped, so it cannot be cancelled", nil
+	}
+
+	_, err = tx.Exec(`
+		UPDATE orders
+		SET status = 'cancelled', updated_at = CURRENT_TIMESTAMP
+		WHERE id = $1`,
+		partnerID)
+	if err != nil {
+		return "", err
+	}
+
+	if !restocked {
+		if err := restockCancelledOrder(tx, partnerID); err != nil {
+			return "", err
+		}
+	}
+
+	err = createNotification(tx, partnerBuyerID, "order_status", partnerID,
+		fmt.Sprintf("Your order #%s has been cancelled because the other side of the swap was cancelled. Reason: %s", partnerID, reason))
+	return "", err
+}
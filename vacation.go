@@ -0,0 +1,193 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+type VacationSettings struct {
+	StartsAt  time.Time `json:"starts_at"`
+	EndsAt    time.Time `json:"ends_at"`
+	AutoReply string    `json:"auto_reply"`
+	Active    bool      `json:"active"`
+}
+
+// sellerNotOnVacationSQL hides listings of sellers who are currently away.
+// It expects the items table to be aliased as i.
+const sellerNotOnVacationSQL = ` AND NOT EXISTS (
+        SELECT 1 FROM vacation_settings v
+        WHERE v.user_id = i.seller_id
+        AND CURRENT_TIMESTAMP >= v.starts_at
+        AND CURRENT_TIMESTAMP < v.ends_at
+      )`
+
+// queryRower is satisfied by both *sql.DB and *sql.Tx
+type queryRower interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// getActiveVacation returns the user's vacation settings if the vacation is
+// currently in progress, or nil otherwise.
+func getActiveVacation(q queryRower, userID string) (*VacationSettings, error) {
+	var v VacationSettings
+	err := q.QueryRow(`
+		SELECT starts_at, ends_at, auto_reply
+		FROM vacation_settings
+		WHERE user_id = $1
+		AND CURRENT_TIMESTAMP >= starts_at
+		AND CURRENT_TIMESTAMP < ends_at`,
+		userID).Scan(&v.StartsAt, &v.EndsAt, &v.AutoReply)
+
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	v.Active = true
+	return &v, nil
+}
+
+func vacationHandler(w http.ResponseWriter, r *http.Request) {
+	userID, _ := getUserIDFromContext(r.Context())
+
+	switch r.Method {
+	case http.MethodGet:
+		var v VacationSettings
+		err := db.QueryRow(`
+			SELECT starts_at, ends_at, auto_reply,
+				   CURRENT_TIMESTAMP >= starts_at AND CURRENT_TIMESTAMP < ends_at
+			FROM vacation_settings
+			WHERE user_id = $1`,
+			userID).Scan(&v.StartsAt, &v.EndsAt, &v.AutoReply, &v.Active)
+
+		if err == sql.ErrNoRows {
+			sendJSON(w, nil)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		sendJSON(w, v)
+
+	case http.MethodPut:
+		var v VacationSettings
+		if err := json.NewDecoder(r.Body).Decode(&v); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if !v.EndsAt.After(v.StartsAt) {
+			http.Error(w, "ends_at must be after starts_at", http.StatusBadRequest)
+			return
+		}
+		if !v.EndsAt.After(time.Now()) {
+			http.Error(w, "ends_at must be in the future", http.StatusBadRequest)
+			return
+		}
+
+		if v.AutoReply == "" {
+			v.AutoReply = fmt.Sprintf("I'm away until %s and will reply to your message when I'm back.",
+				v.EndsAt.Format("2 January 2006"))
+		}
+
+		err := db.QueryRow(`
+			INSERT INTO vacation_settings (user_id, starts_at, ends_at, auto_reply)
+			VALUES ($1, $2, $3, $4)
+			ON CONFLICT (user_id) DO UPDATE
+			SET starts_at = EXCLUDED.starts_at,
+				ends_at = EXCLUDED.ends_at,
+				auto_reply = EXCLUDED.auto_reply,
+				updated_at = CURRENT_TIMESTAMP
+			RETURNING CURRENT_TIMESTAMP >= starts_at AND CURRENT_TIMESTAMP < ends_at`,
+			userID, v.StartsAt, v.EndsAt, v.AutoReply).Scan(&v.Active)
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		sendJSON(w, v)
+
+	case http.MethodDelete:
+		_, err := db.Exec(`DELETE FROM vacation_settings WHERE user_id = $1`, userID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// sendVacationAutoReplies posts an automatic reply on an order thread for
+// every other participant who is on vacation. Each participant replies at
+// most once per thread during a vacation.
+func sendVacationAutoReplies(orderID, senderID string) error {
+	rows, err := db.Query(`
+		SELECT DISTINCT v.user_id, v.auto_reply
+		FROM vacation_settings v
+		WHERE v.user_id != $2
+		AND CURRENT_TIMESTAMP >= v.starts_at
+		AND CURRENT_TIMESTAMP < v.ends_at
+		AND (
+				v.user_id = (SELECT user_id FROM orders WHERE id = $1)
+				OR v.user_id IN (
+						SELECT i.seller_id FROM order_items oi
+						JOIN items i ON oi.item_id = i.id
+						WHERE oi.order_id = $1
+				)
+		)
+		AND NOT EXISTS (
+				SELECT 1 FROM messages m
+				WHERE m.order_id = $1
+				AND m.sender_id = v.user_id
+				AND m.is_auto_reply
+				AND m.created_at >= v.starts_at
+		)`,
+		orderID, senderID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	type autoReply struct {
+		userID  string
+		message string
+	}
+
+	var replies []autoReply
+	for rows.Next() {
+		var reply autoReply
+		if err := rows.Scan(&reply.userID, &reply.message); err != nil {
+			return err
+		}
+		replies = append(replies, reply)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, reply := range replies {
+		_, err := db.Exec(`
+			INSERT INTO messages (order_id, sender_id, message, is_auto_reply)
+			VALUES ($1, $2, $3, true)`,
+			orderID, reply.userID, reply.message)
+		if err != nil {
+			return err
+		}
+		log.Printf("Posted vacation auto-reply from %s on order %s", reply.userID, orderID)
+	}
+
+	return nil
+}